@@ -5,6 +5,10 @@ import (
 	"time"
 )
 
+// Print durations and sizes in human readable units, or exact milliseconds
+// and bytes for log parsing when false.
+var HumanReadable = true
+
 // Duration to e.g. 432ms or 12s, human readable translation
 func BeautifyDuration(d time.Duration) string {
 	u, ms, s := uint64(d), uint64(time.Millisecond), uint64(time.Second)
@@ -12,6 +16,8 @@ func BeautifyDuration(d time.Duration) string {
 		u = -u
 	}
 	switch {
+	case !HumanReadable:
+		return strconv.FormatUint(u/ms, 10) + "ms"
 	case u < ms:
 		return "0"
 	case u < s:
@@ -21,13 +27,16 @@ func BeautifyDuration(d time.Duration) string {
 	}
 }
 
+// Size in bytes to e.g. 12KB or 3GB, human readable translation
 func BeautifySize(s int64) string {
 	switch {
-	case s < 1024:
+	case !HumanReadable || s < 1024:
 		return strconv.FormatInt(s, 10) + "B"
 	case s < 1024*1024:
 		return strconv.FormatInt(s/1024, 10) + "KB"
-	default:
+	case s < 1024*1024*1024:
 		return strconv.FormatInt(s/1024/1024, 10) + "MB"
+	default:
+		return strconv.FormatInt(s/1024/1024/1024, 10) + "GB"
 	}
 }
@@ -0,0 +1,70 @@
+package mallory
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parse CIDRs, a single IP is a /32 or /128
+func ParseCIDRs(list []string) (nets []*net.IPNet, err error) {
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %s", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientChain is the client address of r and the X-Forwarded-For chain, e.g.
+//
+//	remote=10.0.0.2 xff=[198.51.100.1(untrusted) 203.0.113.7(trusted)]
+//
+// An X-Forwarded-For address is trusted if all the hops after it are trusted proxies.
+func ClientChain(r *http.Request, trusted []*net.IPNet) string {
+	remote := HostOnly(r.RemoteAddr)
+	var hops []string
+	for _, v := range r.Header["X-Forwarded-For"] {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hops = append(hops, h)
+			}
+		}
+	}
+	if len(hops) == 0 {
+		return "remote=" + remote
+	}
+
+	// walk from the nearest hop, which is reported by the client
+	marked := make([]string, len(hops))
+	reporter, ok := net.ParseIP(remote), true
+	for i := len(hops) - 1; i >= 0; i-- {
+		ok = ok && containsIP(trusted, reporter)
+		if ok {
+			marked[i] = hops[i] + "(trusted)"
+		} else {
+			marked[i] = hops[i] + "(untrusted)"
+		}
+		reporter = net.ParseIP(HostOnly(hops[i]))
+	}
+	return "remote=" + remote + " xff=[" + strings.Join(marked, " ") + "]"
+}
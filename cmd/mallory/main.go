@@ -1,11 +1,15 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"golang.org/x/net/publicsuffix"
 
@@ -13,13 +17,40 @@ import (
 )
 
 var (
-	FConfig = flag.String("config", "$HOME/.config/mallory.json", "config file")
-	FSuffix = flag.String("suffix", "", "print pulbic suffix for the given domain")
-	FReload = flag.Bool("reload", false, "send signal to reload config file")
+	FConfig   = flag.String("config", "$HOME/.config/mallory.json", "config file")
+	FSuffix   = flag.String("suffix", "", "print pulbic suffix for the given domain")
+	FReload   = flag.Bool("reload", false, "send signal to reload config file")
+	FProfile  = flag.String("profile", "", "config profile to apply, same as env var MALLORY_PROFILE")
+	FVersion  = flag.Bool("version", false, "print version and build info")
+	FValidate = flag.Bool("validate", false, "check config file and exit")
 )
 
+// serve HTTPS proxy if the certificate is set, or HTTP proxy
+func listen(f *ConfigFile, conns *ConnLimit, addr string, h http.Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	l = conns.Listener(l)
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: time.Millisecond * time.Duration(f.ReadHeaderTimeoutMS),
+		ReadTimeout:       time.Millisecond * time.Duration(f.ReadTimeoutMS),
+		WriteTimeout:      time.Millisecond * time.Duration(f.WriteTimeoutMS),
+		IdleTimeout:       time.Millisecond * time.Duration(f.IdleTimeoutMS),
+		// OPTIONS * is answered by the handler
+		DisableGeneralOptionsHandler: true,
+	}
+	if f.LocalTLSCert != "" {
+		L.Printf("Serving TLS on %s\n", addr)
+		return srv.ServeTLS(l, f.LocalTLSCert, f.LocalTLSKey)
+	}
+	return srv.Serve(l)
+}
+
 func serve() {
 	L.Printf("Starting...\n")
+	L.Printf("%s\n", BuildInfo())
 	L.Printf("PID: %d\n", os.Getpid())
 
 	c, err := NewConfig(*FConfig)
@@ -27,7 +58,18 @@ func serve() {
 		L.Fatalln(err)
 	}
 
-	L.Printf("Connecting remote SSH server: %s\n", c.File.RemoteServer)
+	// set before the servers log anything
+	HumanReadable = c.File.HumanReadable
+
+	if features := c.File.EnabledFeatures(); len(features) > 0 {
+		L.Printf("Experimental features: %s\n", strings.Join(features, ", "))
+	}
+
+	L.Printf("Connecting remote server: %s\n", c.File.RemoteServer)
+
+	// shared by all local servers
+	conns := NewConnLimit(c.File.MaxConnections)
+	limit := NewLimiter(c.File.MaxConcurrent, c.File.QoSReserved, time.Millisecond*time.Duration(c.File.QueueTimeoutMS))
 
 	wait := make(chan int)
 	go func() {
@@ -35,8 +77,15 @@ func serve() {
 		if err != nil {
 			L.Fatalln(err)
 		}
+		normal.Conns = conns
+		normal.Limit = limit
+		if url := c.File.SelfTestURL; url != "" {
+			if err := normal.SelfTest(url); err != nil {
+				L.Fatalln(err)
+			}
+		}
 		L.Printf("Local normal HTTP proxy: %s\n", c.File.LocalNormalServer)
-		L.Fatalln(http.ListenAndServe(c.File.LocalNormalServer, normal))
+		L.Fatalln(listen(c.File, conns, c.File.LocalNormalServer, normal))
 		wait <- 1
 	}()
 
@@ -45,10 +94,29 @@ func serve() {
 		if err != nil {
 			L.Fatalln(err)
 		}
+		smart.Conns = conns
+		smart.Limit = limit
 		L.Printf("Local smart HTTP proxy: %s\n", c.File.LocalSmartServer)
-		L.Fatalln(http.ListenAndServe(c.File.LocalSmartServer, smart))
+		L.Fatalln(listen(c.File, conns, c.File.LocalSmartServer, smart))
 		wait <- 1
 	}()
+	if addr := c.File.LocalTransparentServer; addr != "" {
+		go func() {
+			transparent, err := NewServer(SmartSrv, c)
+			if err != nil {
+				L.Fatalln(err)
+			}
+			l, err := ListenTransparent(addr, c.File.TransparentTProxy)
+			if err != nil {
+				L.Fatalln(err)
+			}
+			transparent.Conns = conns
+			transparent.Limit = limit
+			L.Printf("Local transparent proxy: %s\n", addr)
+			L.Fatalln(transparent.ServeTransparent(conns.Listener(l)))
+			wait <- 1
+		}()
+	}
 	<-wait
 }
 
@@ -65,7 +133,15 @@ func reload() {
 	if err != nil {
 		L.Fatal(err)
 	}
-	res, err := http.Get(fmt.Sprintf("http://%s/reload", file.LocalNormalServer))
+	scheme, cli := "http", http.DefaultClient
+	if file.LocalTLSCert != "" {
+		// it is our own server, the certificate may be self signed
+		scheme = "https"
+		cli = &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+	}
+	res, err := cli.Get(fmt.Sprintf("%s://%s/reload", scheme, file.LocalNormalServer))
 	if err != nil {
 		L.Fatal(err)
 	}
@@ -77,11 +153,32 @@ func reload() {
 	fmt.Printf("%s\n", body)
 }
 
+func validate() {
+	path := os.ExpandEnv(*FConfig)
+	file, err := NewConfigFile(path)
+	if err == nil {
+		_, err = NewErrorPages(file.ErrorTemplateDir)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s is valid\n", path)
+}
+
 func main() {
 	flag.Parse()
 
-	if *FSuffix != "" {
+	if *FProfile != "" {
+		os.Setenv("MALLORY_PROFILE", *FProfile)
+	}
+
+	if *FVersion {
+		fmt.Println(BuildInfo())
+	} else if *FSuffix != "" {
 		printSuffix()
+	} else if *FValidate {
+		validate()
 	} else if *FReload {
 		reload()
 	} else {
@@ -0,0 +1,136 @@
+package mallory
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// largest response body shared by coalesced requests
+const coalesceMaxBody = 1 << 20
+
+var errNotCoalesced = errors.New("response can not be coalesced")
+
+// request headers that may change the response, part of the coalescing key
+var coalesceHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Accept-Language",
+	"If-Match",
+	"If-Modified-Since",
+	"If-None-Match",
+	"If-Unmodified-Since",
+	"Range",
+	"User-Agent",
+}
+
+// response shared by the coalesced requests
+type coalesced struct {
+	resp *http.Response
+	body []byte
+}
+
+// only idempotent GETs without body and credentials are coalesced
+func coalescable(r *http.Request) bool {
+	if r.Method != "GET" || (r.ContentLength != 0 && r.Body != nil && r.Body != http.NoBody) {
+		return false
+	}
+	for _, k := range []string{"Authorization", "Cookie"} {
+		if r.Header.Get(k) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// response for one client only, e.g. with its session cookie
+func private(resp *http.Response) bool {
+	if len(resp.Header["Set-Cookie"]) > 0 {
+		return true
+	}
+	for _, v := range resp.Header["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if d == "no-store" || d == "private" || strings.HasPrefix(d, "private=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func coalesceKey(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method + " " + r.URL.String())
+	for _, k := range coalesceHeaders {
+		b.WriteString("\n" + k + ": " + strings.Join(r.Header[k], ","))
+	}
+	return b.String()
+}
+
+// RoundTrip r, concurrent identical GETs share one fetch if Coalesce is set.
+// Streaming, large and private responses are not shared, duplicates fetch them
+// on their own.
+func (self *Direct) roundTrip(r *http.Request) (*http.Response, error) {
+	if !self.Coalesce || !coalescable(r) {
+		return self.transport().RoundTrip(r)
+	}
+
+	// response not shared, only for the request that fetched it
+	var own *http.Response
+	leader := false
+
+	v, err := self.sf.Do(coalesceKey(r), func() (interface{}, error) {
+		leader = true
+		resp, err := self.transport().RoundTrip(r)
+		if err != nil {
+			return nil, err
+		}
+		ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if ct == "text/event-stream" || resp.ContentLength > coalesceMaxBody || private(resp) {
+			own = resp
+			return nil, errNotCoalesced
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, coalesceMaxBody+1))
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if len(body) > coalesceMaxBody {
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			own = resp
+			return nil, errNotCoalesced
+		}
+		resp.Body.Close()
+		return &coalesced{resp: resp, body: body}, nil
+	})
+
+	if own != nil {
+		return own, nil
+	}
+	if err == errNotCoalesced {
+		return self.transport().RoundTrip(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := v.(*coalesced)
+	if !leader {
+		L.Printf("COALESCED %s %s\n", r.Method, r.URL)
+	}
+	// headers are changed by each request, e.g. RemoveHopHeaders
+	resp := *c.resp
+	resp.Header = c.resp.Header.Clone()
+	resp.Trailer = c.resp.Trailer.Clone()
+	resp.Request = r
+	resp.Body = ioutil.NopCloser(bytes.NewReader(c.body))
+	return &resp, nil
+}
@@ -1,14 +1,26 @@
 package mallory
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"gopkg.in/fsnotify.v1"
 )
@@ -21,30 +33,408 @@ type ConfigFile struct {
 	LocalSmartServer string `json:"local_smart"`
 	// local addr to listen and serve, default is 127.0.0.1:1316
 	LocalNormalServer string `json:"local_normal"`
-	// remote addr to connect, e.g. ssh://user@linode.my:22
+	// local addr of the transparent proxy for iptables redirected connections, none if empty
+	LocalTransparentServer string `json:"local_transparent"`
+	// the transparent proxy is the target of iptables TPROXY instead of REDIRECT
+	TransparentTProxy bool `json:"transparent_tproxy"`
+	// ports of transparent connections routed by the SNI of TLS, default is 443
+	TransparentSNIPorts []int `json:"transparent_sni_ports"`
+	// certificate and key files to serve the local addrs over TLS, plain HTTP if empty
+	LocalTLSCert string `json:"local_tls_cert"`
+	LocalTLSKey  string `json:"local_tls_key"`
+	// remote addr to connect, e.g. ssh://user@linode.my:22 or parent proxy http://linode.my:1316
 	RemoteServer string `json:"remote"`
 	// direct to proxy dial timeout
 	ShouldProxyTimeoutMS int `json:"should_proxy_timeout_ms"`
 	// blocked host list
 	BlockedList []string `json:"blocked"`
+	// directory of <class>.html error page templates, built-in pages if empty
+	ErrorTemplateDir string `json:"error_template_dir"`
+	// glob list of hosts to skip TLS certificate verification, e.g. *.corp.lan
+	InsecureHosts []string `json:"insecure_hosts"`
+	// experimental features to enable, e.g. {"coalesce": true}
+	Features map[string]bool `json:"features"`
+	// print sizes and durations in human readable units, default is true
+	HumanReadable bool `json:"human_readable"`
+	// methods sent again after a response like 503 with Retry-After,
+	// any method with Idempotency-Key
+	RetryMethods []string `json:"retry_methods"`
+	// client headers never removed as hop-by-hop headers, e.g. Accept-Encoding
+	PreserveHeaders []string `json:"preserve_headers"`
+	// largest request body in bytes sent to remote servers, 0 is unlimited
+	MaxRequestBody int64 `json:"max_request_body"`
+	// wait for 100 Continue of remote server before sending the body of
+	// Expect: 100-continue requests, default is 1000
+	ExpectContinueTimeoutMS int `json:"expect_continue_timeout_ms"`
+	// TCP keepalive period of CONNECT tunnels, 0 keeps the system default
+	TCPKeepAliveMS int `json:"tcp_keepalive_ms"`
+	// add X-Mallory-Engine: direct|ssh to responses
+	AddEngineHeader bool `json:"add_engine_header"`
+	// wait for Retry-After of 429 and 503 responses and retry once
+	HonorRetryAfter bool `json:"honor_retry_after"`
+	// longest wait for Retry-After, default is 10000
+	MaxRetryAfterMS int `json:"max_retry_after_ms"`
+	// DNS servers ip:port for direct connections, system resolver if empty
+	DNSServers []string `json:"dns_servers"`
+	// credentials for a parent proxy remote, user:passwd for basic
+	UpstreamProxyAuth string `json:"upstream_proxy_auth"`
+	// auth scheme of upstream_proxy_auth, default is basic
+	UpstreamProxyAuthScheme string `json:"upstream_proxy_auth_scheme"`
+	// log the client address and X-Forwarded-For chain of requests
+	LogClientChain bool `json:"log_client_chain"`
+	// CIDRs of proxies whose X-Forwarded-For is trusted
+	TrustedProxies []string `json:"trusted_proxies"`
+	trustedNets    []*net.IPNet
+	// local IP of outgoing connections, e.g. to choose the uplink
+	DialSourceIP string `json:"dial_source_ip"`
+	// concurrent proxied requests, 0 is unlimited
+	MaxConcurrent int `json:"max_concurrent"`
+	// longest wait for a free slot when max_concurrent is reached, 0 fails at once
+	QueueTimeoutMS int `json:"queue_timeout_ms"`
+	// methods allowed through the proxy, all but TRACE if empty
+	AllowedMethods []string `json:"allowed_methods"`
+	// URL fetched through the remote server at startup, startup fails if it does not work
+	SelfTestURL string `json:"self_test_url"`
+	// flush responses to clients at most this long after a write, -1 flushes at once
+	FlushIntervalMS int `json:"flush_interval_ms"`
+	// flush responses to clients once this many bytes are not flushed
+	FlushBytes int `json:"flush_bytes"`
+	// send comment lines on text/event-stream responses idle for this long, 0 never sends
+	StreamKeepAliveMS int `json:"stream_keepalive_ms"`
+	// close CONNECT tunnels after this long even if they are active, 0 never closes them
+	MaxTunnelDurationMS int `json:"max_tunnel_duration_ms"`
+	// append "1.1 <via_pseudonym>" to Via of requests and responses
+	AddViaHeader bool `json:"add_via_header"`
+	// name in Via, default is mallory
+	ViaPseudonym string `json:"via_pseudonym"`
+	// Proxy-Agent of CONNECT responses, none if empty
+	ProxyAgent string `json:"proxy_agent"`
+	// remove Via of requests and responses for privacy
+	StripVia bool `json:"strip_via"`
+	// id of this mallory in Via to detect proxy loops, random if empty
+	InstanceID string `json:"instance_id"`
+	// timeouts of the local servers reading requests from and writing
+	// responses to clients, 0 never times out
+	ReadHeaderTimeoutMS int `json:"read_header_timeout_ms"`
+	ReadTimeoutMS       int `json:"read_timeout_ms"`
+	WriteTimeoutMS      int `json:"write_timeout_ms"`
+	// longest time of idle keep-alive connections from clients
+	IdleTimeoutMS int `json:"idle_timeout_ms"`
+	// limit of open client connections of all local servers, 0 for no limit
+	MaxConnections int `json:"max_connections"`
+	// longest time of a request to destinations, 0 never times out
+	TimeoutMS int `json:"timeout_ms"`
+	// timeout_ms of hosts matching the glob patterns, e.g. {"*.slow.com": 120000}
+	HostTimeoutsMS map[string]int `json:"host_timeouts_ms"`
+	// reject proxied requests with 503, except clients in maintenance_allow
+	Maintenance bool `json:"maintenance"`
+	// CIDRs of clients not affected by maintenance mode
+	MaintenanceAllow []string `json:"maintenance_allow"`
+	maintenanceNets  []*net.IPNet
+	// Retry-After of the 503 in maintenance mode, 0 sends none
+	MaintenanceRetryAfterS int `json:"maintenance_retry_after_s"`
+	// percent of clients of hosts matching the glob patterns that go through
+	// the remote, the others connect directly, e.g. {"*.example.com": 10}
+	RemoteWeights map[string]int `json:"remote_weights"`
+	// sink of per request and tunnel summaries: stdout, udp://host:port or a file
+	FlowLog string `json:"flow_log"`
+	// slots of max_concurrent only for interactive requests, not bulk ones
+	QoSReserved int `json:"qos_reserved"`
+	// requests to hosts matching the glob patterns are bulk requests
+	QoSBulkHosts []string `json:"qos_bulk_hosts"`
+	// requests with a larger body are bulk requests, 0 for no limit
+	QoSBulkBytes int64 `json:"qos_bulk_bytes"`
+	// serve a page with proxy settings to requests for mallory itself, or a 400
+	LandingPage bool `json:"landing_page"`
+	// check a config from URL for changes this often, 0 never checks
+	ConfigPollMS int `json:"config_poll_ms"`
+	// profile to apply, overridden by env var MALLORY_PROFILE
+	Profile string `json:"profile"`
+	// named overrides of the fields above, maps are merged and others replaced
+	Profiles map[string]json.RawMessage `json:"profiles"`
 }
 
-// Load file from path
+// random id of this process, when instance_id is not set
+var instanceID = func() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+
+// Config with the defaults of all fields, a config file overrides them
+func DefaultConfigFile() *ConfigFile {
+	return &ConfigFile{
+		LocalSmartServer:  "127.0.0.1:1315",
+		LocalNormalServer: "127.0.0.1:1316",
+		HumanReadable:     true,
+		RetryMethods:      append([]string(nil), defaultRetryMethods...),
+
+		ShouldProxyTimeoutMS:    200,
+		ExpectContinueTimeoutMS: 1000,
+		MaxRetryAfterMS:         10000,
+		ViaPseudonym:            "mallory",
+		MaintenanceRetryAfterS:  60,
+		ReadHeaderTimeoutMS:     10000,
+		IdleTimeoutMS:           120000,
+		TransparentSNIPorts:     []int{443},
+	}
+}
+
+// Decode JSON data into v, unknown fields are errors. data is file or a part
+// of it, errors have the line and column in file.
+func decodeStrict(file, data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		if _, err = dec.Token(); err == io.EOF {
+			err = exactKeys(file, data)
+			if err == nil {
+				return nil
+			}
+		} else {
+			err = errors.New("invalid data after top-level value")
+		}
+	}
+
+	offset := dec.InputOffset()
+	var kerr *keyError
+	var serr *json.SyntaxError
+	var terr *json.UnmarshalTypeError
+	if errors.As(err, &serr) {
+		offset = serr.Offset
+	} else if errors.As(err, &terr) {
+		offset = terr.Offset
+	} else if errors.As(err, &kerr) {
+		offset = kerr.Offset
+	}
+	if i := bytes.Index(file, data); i > 0 {
+		offset += int64(i)
+	}
+	if offset > int64(len(file)) {
+		offset = int64(len(file))
+	}
+	line, col := 1, 1
+	for _, c := range file[:offset] {
+		if c == '\n' {
+			line, col = line+1, 1
+		} else {
+			col++
+		}
+	}
+	return fmt.Errorf("line %d column %d: %s", line, col, strings.TrimPrefix(err.Error(), "json: "))
+}
+
+// field name of data in a different case than its json tag
+type keyError struct {
+	Key, Field string
+	Offset     int64
+}
+
+func (e *keyError) Error() string {
+	return fmt.Sprintf("unknown field %q, did you mean %q", e.Key, e.Field)
+}
+
+// Check the field names of data match the json tags of ConfigFile exactly,
+// encoding/json accepts them in any case.
+func exactKeys(file, data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	t := reflect.TypeOf(ConfigFile{})
+	tags := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		tags[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = true
+	}
+	for key := range fields {
+		if tags[key] {
+			continue
+		}
+		for tag := range tags {
+			if strings.EqualFold(tag, key) {
+				offset := bytes.Index(data, []byte(`"`+key+`"`))
+				return &keyError{Key: key, Field: tag, Offset: int64(offset)}
+			}
+		}
+	}
+	return nil
+}
+
+// Load file from path, or fetch it if path is an http(s) URL
 func NewConfigFile(path string) (self *ConfigFile, err error) {
-	self = &ConfigFile{}
-	buf, err := ioutil.ReadFile(path)
+	var buf []byte
+	if isConfigURL(path) {
+		buf, err = fetchConfig(path)
+	} else {
+		buf, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return
+	}
+	return ParseConfigFile(path, buf)
+}
+
+// Parse and check the content of config file from path
+func ParseConfigFile(path string, buf []byte) (self *ConfigFile, err error) {
+	self = DefaultConfigFile()
+	err = decodeStrict(buf, buf, self)
+	if err != nil {
+		err = fmt.Errorf("%s: %s", path, err)
+		return
+	}
+	if p := os.Getenv("MALLORY_PROFILE"); p != "" {
+		self.Profile = p
+	}
+	if self.Profile != "" {
+		raw, ok := self.Profiles[self.Profile]
+		if !ok {
+			err = fmt.Errorf("profile %q not found in %s", self.Profile, path)
+			return
+		}
+		// unmarshal into the loaded config, keeps fields missing in profile
+		err = decodeStrict(buf, raw, self)
+		if err != nil {
+			err = fmt.Errorf("%s: profile %q: %s", path, self.Profile, err)
+			return
+		}
+	}
+	self.loadFeatures()
+	if self.InstanceID == "" {
+		self.InstanceID = instanceID
+	}
+	err = self.Validate()
 	if err != nil {
 		return
 	}
-	err = json.Unmarshal(buf, self)
+	self.trustedNets, err = ParseCIDRs(self.TrustedProxies)
+	if err != nil {
+		return
+	}
+	self.maintenanceNets, err = ParseCIDRs(self.MaintenanceAllow)
 	if err != nil {
 		return
 	}
 	self.PrivateKey = os.ExpandEnv(self.PrivateKey)
+	self.ErrorTemplateDir = os.ExpandEnv(self.ErrorTemplateDir)
+	self.LocalTLSCert = os.ExpandEnv(self.LocalTLSCert)
+	self.LocalTLSKey = os.ExpandEnv(self.LocalTLSKey)
 	sort.Strings(self.BlockedList)
 	return
 }
 
+// check the config is usable
+func (self *ConfigFile) Validate() error {
+	if self.RemoteServer == "" {
+		return errors.New("remote is missing")
+	}
+	if (self.LocalTLSCert == "") != (self.LocalTLSKey == "") {
+		return errors.New("local_tls_cert and local_tls_key must be set together")
+	}
+	return nil
+}
+
+// value of the longest glob pattern matching host
+func matchHost(patterns map[string]int, host string) (value int, ok bool) {
+	host = HostOnly(host)
+	best := -1
+	for pattern, v := range patterns {
+		if m, _ := path.Match(pattern, host); m && len(pattern) > best {
+			value, best, ok = v, len(pattern), true
+		}
+	}
+	return
+}
+
+// timeout of requests to host, from the longest matching pattern of
+// host_timeouts_ms, or timeout_ms if none matches
+func (self *ConfigFile) Timeout(host string) time.Duration {
+	ms, ok := matchHost(self.HostTimeoutsMS, host)
+	if !ok {
+		ms = self.TimeoutMS
+	}
+	return time.Millisecond * time.Duration(ms)
+}
+
+// percent of clients of host routed through the remote, from the longest
+// matching pattern of remote_weights, false if none matches
+func (self *ConfigFile) RemoteWeight(host string) (int, bool) {
+	return matchHost(self.RemoteWeights, host)
+}
+
+// test whether r is a bulk request or an interactive one
+func (self *ConfigFile) Bulk(r *http.Request) bool {
+	if self.QoSBulkBytes > 0 && r.ContentLength > self.QoSBulkBytes {
+		return true
+	}
+	host := HostOnly(r.URL.Host)
+	for _, pattern := range self.QoSBulkHosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pseudonym added to Via, empty if not adding Via
+func (self *ConfigFile) Via() string {
+	if !self.AddViaHeader {
+		return ""
+	}
+	return self.ViaID()
+}
+
+// pseudonym with the instance id, e.g. mallory (4f2a9c1e)
+func (self *ConfigFile) ViaID() string {
+	return self.ViaPseudonym + " (" + self.InstanceID + ")"
+}
+
+// test whether the request went through this mallory before or not
+func (self *ConfigFile) Looped(h http.Header) bool {
+	id := "(" + self.InstanceID + ")"
+	for _, v := range h["Via"] {
+		if strings.Contains(v, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// test whether method is allowed through the proxy,
+// TRACE is only allowed if it is in allowed_methods.
+func (self *ConfigFile) MethodAllowed(method string) bool {
+	if len(self.AllowedMethods) == 0 {
+		return method != "TRACE"
+	}
+	for _, m := range self.AllowedMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// methods allowed by default, the standard ones but TRACE
+var defaultMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "CONNECT", "OPTIONS"}
+
+// value of the Allow header, the methods allowed through the proxy
+func (self *ConfigFile) Allow() string {
+	if len(self.AllowedMethods) == 0 {
+		return strings.Join(defaultMethods, ", ")
+	}
+	return strings.Join(self.AllowedMethods, ", ")
+}
+
+// TrustedProxies parsed
+func (self *ConfigFile) TrustedNets() []*net.IPNet {
+	return self.trustedNets
+}
+
+// MaintenanceAllow parsed
+func (self *ConfigFile) MaintenanceNets() []*net.IPNet {
+	return self.maintenanceNets
+}
+
 // test whether host is in blocked list or not
 func (self *ConfigFile) Blocked(host string) bool {
 	i := sort.SearchStrings(self.BlockedList, host)
@@ -62,6 +452,11 @@ type Config struct {
 	// mutex for config file
 	mutex  sync.RWMutex
 	loaded bool
+	// maintenance mode set at runtime, 1 if on
+	maintenance int32
+	// last content fetched from the remote config
+	fetched      []byte
+	fetchedMutex sync.Mutex
 }
 
 func NewConfig(path string) (self *Config, err error) {
@@ -80,7 +475,10 @@ func NewConfig(path string) (self *Config, err error) {
 }
 
 func (self *Config) Reload() (err error) {
-	file, err := NewConfigFile(self.Path)
+	file, err := self.readFile()
+	if err == errConfigUnchanged {
+		return nil
+	}
 	if err != nil {
 		L.Printf("Reload %s failed: %s\n", self.Path, err)
 	} else {
@@ -101,31 +499,39 @@ func (self *Config) Load() (err error) {
 
 	// first time to load
 	L.Printf("Loading: %s\n", self.Path)
-	self.File, err = NewConfigFile(self.Path)
-	if err != nil {
-		return
+	self.File, err = self.readFile()
+	if err != nil && isConfigURL(self.Path) {
+		L.Printf("Fetch %s failed: %s, loading the last good one\n", self.Path, err)
+		self.File, err = ParseConfigFile(self.Path, self.readCache())
 	}
-
-	// Watching the whole directory instead of the individual path.
-	// Because many editors won't write to file directly, they copy
-	// the original one and rename it.
-	err = self.Watcher.Add(filepath.Dir(self.Path))
 	if err != nil {
 		return
 	}
 
-	go func() {
-		for {
-			select {
-			case event := <-self.Watcher.Events:
-				if event.Op&fsnotify.Write == fsnotify.Write && event.Name == self.Path {
-					self.Reload()
+	if isConfigURL(self.Path) {
+		go self.poll()
+	} else {
+		// Watching the whole directory instead of the individual path.
+		// Because many editors won't write to file directly, they copy
+		// the original one and rename it.
+		err = self.Watcher.Add(filepath.Dir(self.Path))
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for {
+				select {
+				case event := <-self.Watcher.Events:
+					if event.Op&fsnotify.Write == fsnotify.Write && event.Name == self.Path {
+						self.Reload()
+					}
+				case err := <-self.Watcher.Errors:
+					L.Printf("Watching failed: %s\n", err)
 				}
-			case err := <-self.Watcher.Errors:
-				L.Printf("Watching failed: %s\n", err)
 			}
-		}
-	}()
+		}()
+	}
 
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGHUP)
@@ -140,6 +546,22 @@ func (self *Config) Load() (err error) {
 	return
 }
 
+// current config file content, it is replaced but never changed on reload
+func (self *Config) Current() *ConfigFile {
+	self.mutex.RLock()
+	file := self.File
+	self.mutex.RUnlock()
+	return file
+}
+
+// client headers never removed as hop-by-hop headers
+func (self *Config) PreserveHeaders() []string {
+	self.mutex.RLock()
+	preserve := self.File.PreserveHeaders
+	self.mutex.RUnlock()
+	return preserve
+}
+
 // test whether host is in blocked list or not
 func (self *Config) Blocked(host string) bool {
 	self.mutex.RLock()
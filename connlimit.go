@@ -0,0 +1,108 @@
+package mallory
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Limit of open client connections shared by listeners, accepts are paused
+// while max connections are open. Only counts them if max is 0.
+type ConnLimit struct {
+	Max   int
+	slots chan struct{}
+	open  int64
+}
+
+func NewConnLimit(max int) *ConnLimit {
+	self := &ConnLimit{Max: max}
+	if max > 0 {
+		self.slots = make(chan struct{}, max)
+	}
+	return self
+}
+
+// number of open connections
+func (self *ConnLimit) Open() int64 {
+	if self == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&self.open)
+}
+
+// l with its connections counted in the limit
+func (self *ConnLimit) Listener(l net.Listener) net.Listener {
+	return &limitListener{Listener: l, limit: self}
+}
+
+type limitListener struct {
+	net.Listener
+	limit *ConnLimit
+}
+
+func (self *limitListener) Accept() (net.Conn, error) {
+	slots := self.limit.slots
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		default:
+			L.Printf("max_connections %d reached, accept on %s paused\n", self.limit.Max, self.Addr())
+			slots <- struct{}{}
+			L.Printf("Accept on %s resumed\n", self.Addr())
+		}
+	}
+	conn, err := self.Listener.Accept()
+	if err != nil {
+		if slots != nil {
+			<-slots
+		}
+		return nil, err
+	}
+	atomic.AddInt64(&self.limit.open, 1)
+	return &limitConn{Conn: conn, limit: self.limit}, nil
+}
+
+// releases its slot once closed, also when hijacked for CONNECT
+type limitConn struct {
+	net.Conn
+	limit *ConnLimit
+	once  sync.Once
+}
+
+func (self *limitConn) Close() error {
+	err := self.Conn.Close()
+	self.once.Do(func() {
+		atomic.AddInt64(&self.limit.open, -1)
+		if self.limit.slots != nil {
+			<-self.limit.slots
+		}
+	})
+	return err
+}
+
+func (self *limitConn) NetConn() net.Conn {
+	return self.Conn
+}
+
+func (self *limitConn) CloseWrite() error {
+	if c, ok := self.Conn.(closeWriter); ok {
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+// connection wrapped by the conns of this package
+type netConner interface {
+	NetConn() net.Conn
+}
+
+// innermost connection of c, e.g. the *net.TCPConn
+func netConn(c net.Conn) net.Conn {
+	for {
+		u, ok := c.(netConner)
+		if !ok {
+			return c
+		}
+		c = u.NetConn()
+	}
+}
@@ -0,0 +1,70 @@
+package mallory
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// local address of dialers bound to ip, which must be an address of this host
+func LocalAddr(ip string) (net.Addr, error) {
+	want := net.ParseIP(ip)
+	if want == nil {
+		return nil, fmt.Errorf("invalid dial source IP %q", ip)
+	}
+	ok, err := localIP(want)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("dial source IP %s is not an address of this host", ip)
+	}
+	return &net.TCPAddr{IP: want}, nil
+}
+
+// test whether ip is an address of this host or not
+func localIP(ip net.IP) (bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, err
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// dialer bound to the source IP, or any address if ip is empty
+func NewDialer(ip string) (*net.Dialer, error) {
+	d := &net.Dialer{}
+	if ip == "" {
+		return d, nil
+	}
+	addr, err := LocalAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+	d.LocalAddr = addr
+	return d, nil
+}
+
+// test whether host is mallory at the local address addr or not, by the port
+// and an address of this host, e.g. localhost:1316 for 127.0.0.1:1316
+func isSelf(addr net.Addr, host string) bool {
+	ta, ok := addr.(*net.TCPAddr)
+	h, port, err := net.SplitHostPort(host)
+	if !ok || err != nil || port != strconv.Itoa(ta.Port) {
+		return false
+	}
+	if h == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(h)
+	if ip == nil {
+		return false
+	}
+	local, _ := localIP(ip)
+	return local || ip.IsLoopback()
+}
@@ -1,24 +1,69 @@
 package mallory
 
 import (
-	"errors"
+	"context"
+	"crypto/tls"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"path"
+	"runtime/debug"
 	"time"
 )
 
-var (
-	ErrShouldProxy = errors.New("should proxy")
-)
-
 type closeWriter interface {
 	CloseWrite() error
 }
 
 // Direct fetcher
 type Direct struct {
-	Tr *http.Transport
+	// engine name in logs and X-Mallory-Engine, direct or ssh
+	Name string
+	Tr   *http.Transport
+	// round tripper of requests instead of Tr if not nil, e.g. a mock in
+	// tests, or Tr wrapped for tracing. CONNECT tunnels are still dialed by Tr.
+	Transport http.RoundTripper
+	// dialer of Tr, nil if Tr does not dial by net
+	Dialer *net.Dialer
+	// error pages, plain text errors if nil
+	Pages *ErrorPages
+	// summaries of requests and tunnels, none if nil
+	Flows *FlowLog
+	// glob list of hosts to skip TLS certificate verification
+	InsecureHosts []string
+	// share one fetch between concurrent identical GETs
+	Coalesce bool
+	sf       Group
+	// TCP keepalive period of CONNECT tunnels, 0 keeps the default
+	KeepAlive time.Duration
+	// add X-Mallory-Engine to responses
+	EngineHeader bool
+	// pseudonym added to Via of responses, none if empty
+	Via string
+	// Proxy-Agent of CONNECT responses, none if empty
+	ProxyAgent string
+	// remove Via of responses from remote servers
+	StripVia bool
+	// longest wait for Retry-After of 429 and 503 responses, 0 never waits
+	MaxRetryAfter time.Duration
+	// methods sent again after the wait
+	RetryMethods []string
+	// close CONNECT tunnels after this long, 0 never closes them
+	MaxTunnelDuration time.Duration
+	// flush streaming responses at most FlushInterval after a write,
+	// negative to flush at once, or once FlushBytes are not flushed
+	FlushInterval time.Duration
+	FlushBytes    int
+	// send comment lines on event streams idle for this long, 0 never sends
+	StreamKeepAlive time.Duration
+	// relay 1xx informational responses like 103 Early Hints
+	EarlyHints bool
+	// return ErrShouldProxy on timeouts for the remote to retry,
+	// or write the error to client
+	Reproxy bool
 }
 
 // Create and initialize
@@ -26,11 +71,82 @@ func NewDirect(shouldProxyTimeout time.Duration) *Direct {
 	if shouldProxyTimeout == 0 {
 		shouldProxyTimeout = 200 * time.Millisecond
 	}
-	tr := http.DefaultTransport.(*http.Transport)
-	tr.Dial = (&net.Dialer{
+	dialer := &net.Dialer{
 		Timeout: shouldProxyTimeout,
-	}).Dial
-	return &Direct{Tr: tr}
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	// the transport prefers DialContext to Dial, the clone has the default one
+	tr.DialContext = dialer.DialContext
+	tr.Dial = nil
+	return &Direct{Name: "direct", Tr: tr, Dialer: dialer, RetryMethods: append([]string(nil), defaultRetryMethods...), Reproxy: true}
+}
+
+// Transport if set, or Tr
+func (self *Direct) transport() http.RoundTripper {
+	if self.Transport != nil {
+		return self.Transport
+	}
+	return self.Tr
+}
+
+// Skip TLS certificate verification for the given hosts
+func (self *Direct) SetInsecureHosts(hosts []string) {
+	self.InsecureHosts = hosts
+	if len(hosts) > 0 {
+		self.Tr.DialTLS = self.dialTLS
+	} else {
+		self.Tr.DialTLS = nil
+	}
+}
+
+// test whether host matches one of InsecureHosts or not
+func (self *Direct) Insecure(host string) bool {
+	for _, pattern := range self.InsecureHosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// dial by Tr, as the transport does
+func (self *Direct) dial(network, addr string) (net.Conn, error) {
+	if self.Tr.DialContext != nil {
+		return self.Tr.DialContext(context.Background(), network, addr)
+	}
+	return self.Tr.Dial(network, addr)
+}
+
+// TLS dial for the transport, to verify certificates per host
+func (self *Direct) dialTLS(network, addr string) (net.Conn, error) {
+	conn, err := self.dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	host := HostOnly(addr)
+	cfg := &tls.Config{}
+	if self.Tr.TLSClientConfig != nil {
+		cfg = self.Tr.TLSClientConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if self.Insecure(host) {
+		L.Printf("WARNING: skip TLS certificate verification for %s\n", host)
+		cfg.InsecureSkipVerify = true
+	}
+
+	if d := self.Tr.TLSHandshakeTimeout; d > 0 {
+		conn.SetDeadline(time.Now().Add(d))
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
 }
 
 // Data flow:
@@ -45,37 +161,82 @@ func (self *Direct) ServeHTTP(w http.ResponseWriter, r *http.Request) (err error
 		return
 	}
 	start := time.Now()
+	// a copy, the body of the caller is left as is
+	r = r.WithContext(r.Context())
+	up := countBody(r)
+
+	if self.EarlyHints {
+		r = r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				// 100 Continue is sent by the local server when reading the body,
+				// and HTTP/1.0 clients can not take interim responses at all
+				if code == http.StatusContinue || !r.ProtoAtLeast(1, 1) {
+					return nil
+				}
+				h := w.Header()
+				for k, vs := range header {
+					h[k] = vs
+				}
+				w.WriteHeader(code)
+				return nil
+			},
+		}))
+	}
 
 	// Client.Do is different from DefaultTransport.RoundTrip ...
 	// Client.Do will change some part of request as a new request of the server.
 	// The underlying RoundTrip never changes anything of the request.
-	resp, err := self.Tr.RoundTrip(r)
+	resp, err := self.roundTrip(r)
 	if err != nil {
-		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		// no time left to reproxy once the timeout of host is reached
+		if self.Reproxy && isTimeout(err) && r.Context().Err() == nil {
 			L.Printf("RoundTrip: %s, reproxy...\n", err.Error())
 			err = ErrShouldProxy
 			return
 		}
-		L.Printf("RoundTrip: %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		err = classify(err, "RoundTrip")
+		L.Println(err)
+		self.Pages.WriteError(w, r, err)
+		self.Flows.Write(r, self.Name, statusOf(err), up.N(), 0, start)
 		return
 	}
+	if self.MaxRetryAfter > 0 {
+		resp = self.retryAfter(r, resp)
+	}
 	defer resp.Body.Close()
 
+	// Connection and Keep-Alive of the remote server are not for the client,
+	// the local server decides them, e.g. no chunked encoding for HTTP/1.0.
+	RemoveHopHeaders(resp.Header)
+
 	// please prepare header first and write them
 	CopyHeader(w, resp)
+	if self.EngineHeader {
+		w.Header().Set("X-Mallory-Engine", self.Name)
+	}
+	SetVia(w.Header(), resp.ProtoMajor, resp.ProtoMinor, self.Via, self.StripVia)
 	w.WriteHeader(resp.StatusCode)
 
-	n, err := io.Copy(w, resp.Body)
+	var dst io.Writer = w
+	if lw := self.streamWriter(w, resp); lw != nil {
+		defer lw.stop()
+		dst = lw
+	}
+
+	n, err := io.Copy(dst, resp.Body)
 	if err != nil {
 		L.Printf("Copy: %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		self.Flows.Write(r, self.Name, resp.StatusCode, up.N(), n, start)
+		// The status is sent, an error now would be read as part of the body.
+		// Abort the connection, or the stream of HTTP/2, so the client
+		// sees a truncated response instead of a complete one.
+		panic(http.ErrAbortHandler)
 	}
 
 	d := BeautifyDuration(time.Since(start))
 	ndtos := BeautifySize(n)
-	L.Printf("RESPONSE %s %s in %s <-%s\n", r.URL.Host, resp.Status, d, ndtos)
+	L.Printf("RESPONSE %s via %s %s in %s <-%s\n", r.URL.Host, self.Name, resp.Status, d, ndtos)
+	self.Flows.Write(r, self.Name, resp.StatusCode, up.N(), n, start)
 	return
 }
 
@@ -92,43 +253,102 @@ func (self *Direct) Connect(w http.ResponseWriter, r *http.Request) (err error)
 	}
 	start := time.Now()
 
-	// Use Hijacker to get the underlying connection
+	// Use Hijacker to get the underlying connection,
+	// or stream the request and response bodies for HTTP/2.
 	hij, ok := w.(http.Hijacker)
-	if !ok {
+	_, canFlush := w.(http.Flusher)
+	if !ok && !(r.ProtoMajor == 2 && canFlush) {
 		s := "Server does not support Hijacker"
 		L.Println(s)
-		http.Error(w, s, http.StatusInternalServerError)
+		self.Pages.Write(w, r, PageError, s)
 		return
 	}
 
 	// connect the remote client directly
-	dst, err := self.Tr.Dial("tcp", r.URL.Host)
+	dst, err := self.dialTunnel(r.URL.Host)
 	if err != nil {
-		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-			L.Printf("RoundTrip: %s, reproxy...\n", err.Error())
-			err = ErrShouldProxy
-			return
+		if err != ErrShouldProxy {
+			self.Pages.WriteError(w, r, err)
+			self.Flows.Write(r, self.Name, statusOf(err), 0, 0, start)
 		}
-		L.Printf("Dial: %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer dst.Close()
 
+	if !ok {
+		self.connectStream(w, r, dst, start)
+		return
+	}
+
 	src, _, err := hij.Hijack()
 	if err != nil {
 		L.Printf("Hijack: %s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		self.Pages.Write(w, r, PageError, err.Error())
 		return
 	}
 	defer src.Close()
 
-	// Once connected successfully, return OK
-	src.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	// read and write timeouts of the local server are for requests,
+	// not for the tunnel which may be open for long.
+	src.SetDeadline(time.Time{})
+
+	// Once connected successfully, return OK in the version of the client
+	status := fmt.Sprintf("HTTP/%d.%d 200 OK\r\n", r.ProtoMajor, r.ProtoMinor)
+	if self.ProxyAgent != "" {
+		status += "Proxy-Agent: " + self.ProxyAgent + "\r\n"
+	}
+	src.Write([]byte(status + "\r\n"))
+
+	self.tunnel(r, src, dst, start)
+	return
+}
+
+// dial host of a tunnel, ErrShouldProxy if timed out and Reproxy is set
+func (self *Direct) dialTunnel(host string) (net.Conn, error) {
+	dst, err := self.dial("tcp", host)
+	if err != nil {
+		if self.Reproxy && isTimeout(err) {
+			L.Printf("Dial: %s, reproxy...\n", err.Error())
+			return nil, ErrShouldProxy
+		}
+		err = classify(err, "Dial")
+		L.Println(err)
+		return nil, err
+	}
+	return dst, nil
+}
+
+// exchange data between the client src and the remote dst of CONNECT r until both are closed
+func (self *Direct) tunnel(r *http.Request, src, dst net.Conn, start time.Time) {
+	// keep idle tunnels alive through NAT and firewalls,
+	// dst is not a TCP connection when dialed through SSH.
+	if self.KeepAlive > 0 {
+		for _, c := range []net.Conn{src, dst} {
+			if tcpConn, ok := netConn(c).(*net.TCPConn); ok {
+				tcpConn.SetKeepAlive(true)
+				tcpConn.SetKeepAlivePeriod(self.KeepAlive)
+			}
+		}
+	}
+
+	if self.MaxTunnelDuration > 0 {
+		t := self.limitLifetime(r, src, dst)
+		defer t.Stop()
+	}
 
 	// Proxy is no need to know anything, just exchange data between the client
 	// the the remote server.
 	copyAndWait := func(dst, src net.Conn, c chan int64) {
+		var n int64
+		// out of the request goroutine, a panic here would stop the whole process
+		defer func() {
+			if err := recover(); err != nil {
+				L.Printf("PANIC CONNECT %s: %v\n%s", r.URL.Host, err, debug.Stack())
+				dst.Close()
+				src.Close()
+				c <- n
+			}
+		}()
 		n, err := io.Copy(dst, src)
 		if err != nil {
 			L.Printf("Copy: %s\n", err.Error())
@@ -158,7 +378,62 @@ func (self *Direct) Connect(w http.ResponseWriter, r *http.Request) (err error)
 		}
 	}
 	d := BeautifyDuration(time.Since(start))
-	L.Printf("CLOSE %s after %s ->%s <-%s\n",
-		r.URL.Host, d, BeautifySize(nstod), BeautifySize(ndtos))
-	return
+	L.Printf("CLOSE %s via %s after %s ->%s <-%s\n",
+		r.URL.Host, self.Name, d, BeautifySize(nstod), BeautifySize(ndtos))
+	self.Flows.Write(r, self.Name, http.StatusOK, nstod, ndtos, start)
+}
+
+// CONNECT over HTTP/2 has no connection to hijack, the tunnel is the request
+// body from the client and the flushed response body to the client.
+func (self *Direct) connectStream(w http.ResponseWriter, r *http.Request, dst net.Conn, start time.Time) {
+	if self.MaxTunnelDuration > 0 {
+		t := self.limitLifetime(r, dst)
+		defer t.Stop()
+	}
+
+	if self.ProxyAgent != "" {
+		w.Header().Set("Proxy-Agent", self.ProxyAgent)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	// client to remote
+	stod := make(chan int64, 1)
+	go func() {
+		n, err := io.Copy(dst, r.Body)
+		if err != nil {
+			L.Printf("Copy: %s\n", err.Error())
+		}
+		if tcpConn, ok := dst.(closeWriter); ok {
+			tcpConn.CloseWrite()
+		}
+		stod <- n
+	}()
+
+	// remote to client, the stream ends once the remote closed
+	ndtos, err := io.Copy(&flushWriter{w: w, f: w.(http.Flusher)}, dst)
+	if err != nil {
+		L.Printf("Copy: %s\n", err.Error())
+	}
+
+	var nstod int64
+	select {
+	case nstod = <-stod:
+	default:
+	}
+	d := BeautifyDuration(time.Since(start))
+	L.Printf("CLOSE %s via %s after %s ->%s <-%s\n",
+		r.URL.Host, self.Name, d, BeautifySize(nstod), BeautifySize(ndtos))
+	self.Flows.Write(r, self.Name, http.StatusOK, nstod, ndtos, start)
+}
+
+// close the tunnel of r once MaxTunnelDuration is reached, even if it is active
+func (self *Direct) limitLifetime(r *http.Request, conns ...io.Closer) *time.Timer {
+	return time.AfterFunc(self.MaxTunnelDuration, func() {
+		L.Printf("CLOSE %s via %s: max lifetime %s reached\n",
+			r.URL.Host, self.Name, BeautifyDuration(self.MaxTunnelDuration))
+		for _, c := range conns {
+			c.Close()
+		}
+	})
 }
@@ -0,0 +1,109 @@
+package mallory
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// longest wait for one DNS server before asking the next one
+const dnsServerTimeout = 2 * time.Second
+
+// Resolver asks the DNS servers in turn, and the next one if a lookup timed out
+type Resolver struct {
+	// wait for each server, dnsServerTimeout if 0
+	Timeout time.Duration
+	// one for each server
+	servers []*net.Resolver
+	next    uint32
+}
+
+// Resolver of the DNS servers ip:port, queries are sent from the local
+// address sourceIP, any address if it is empty
+func NewResolver(servers []string, sourceIP string) (*Resolver, error) {
+	var ip net.IP
+	if sourceIP != "" {
+		if _, err := LocalAddr(sourceIP); err != nil {
+			return nil, err
+		}
+		ip = net.ParseIP(sourceIP)
+	}
+
+	self := &Resolver{}
+	for _, s := range servers {
+		host, port, err := net.SplitHostPort(s)
+		if err != nil {
+			// port is optional
+			host, port = s, "53"
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid DNS server %q, want ip:port", s)
+		}
+		addr := net.JoinHostPort(host, port)
+		dial := func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			if ip != nil && strings.HasPrefix(network, "udp") {
+				d.LocalAddr = &net.UDPAddr{IP: ip}
+			} else if ip != nil {
+				d.LocalAddr = &net.TCPAddr{IP: ip}
+			}
+			return d.DialContext(ctx, network, addr)
+		}
+		self.servers = append(self.servers, &net.Resolver{PreferGo: true, Dial: dial})
+	}
+	return self, nil
+}
+
+// IP addresses of host, from the next server in turn. Only timeouts are
+// asked again, e.g. a host not found is the same on all servers.
+func (self *Resolver) LookupIPAddr(ctx context.Context, host string) (addrs []net.IPAddr, err error) {
+	timeout := self.Timeout
+	if timeout <= 0 {
+		timeout = dnsServerTimeout
+	}
+	start := int(atomic.AddUint32(&self.next, 1))
+	for i := range self.servers {
+		r := self.servers[(start+i)%len(self.servers)]
+		sctx, cancel := context.WithTimeout(ctx, timeout)
+		addrs, err = r.LookupIPAddr(sctx, host)
+		cancel()
+		if err == nil || !isTimeout(err) || ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
+
+// DialContext of d with hosts resolved by the servers, the addresses are
+// tried in order. The timeout of d covers both.
+func (self *Resolver) Dial(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return d.DialContext(ctx, network, addr)
+		}
+		if d.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+			defer cancel()
+		}
+		ips, err := self.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		for _, ip := range ips {
+			var conn net.Conn
+			conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,138 @@
+package mallory
+
+import (
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Failure classes with a dedicated error page
+const (
+	PageUnreachable = "unreachable"
+	PageQuota       = "quota"
+	PageBlocked     = "blocked"
+	PageAuth        = "auth"
+	PageTooLarge    = "too_large"
+	PageBusy        = "busy"
+	PageMethod      = "method"
+	PageLoop        = "loop"
+	PageMaintenance = "maintenance"
+	PageError       = "error"
+)
+
+// status code served with each failure class
+var pageStatus = map[string]int{
+	PageUnreachable: http.StatusBadGateway,
+	PageQuota:       http.StatusTooManyRequests,
+	PageBlocked:     http.StatusForbidden,
+	PageAuth:        http.StatusProxyAuthRequired,
+	PageTooLarge:    http.StatusRequestEntityTooLarge,
+	PageBusy:        http.StatusServiceUnavailable,
+	PageMethod:      http.StatusMethodNotAllowed,
+	PageLoop:        http.StatusLoopDetected,
+	PageMaintenance: http.StatusServiceUnavailable,
+	PageError:       http.StatusInternalServerError,
+}
+
+// status code of the page of err
+func statusOf(err error) int {
+	return pageStatus[PageOf(err)]
+}
+
+// built-in page, used when ErrorTemplateDir has no <class>.html
+const defaultPage = `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.StatusText}}</h1>
+<p>{{.Explain}}</p>
+{{if .Host}}<p>Host: <code>{{.Host}}</code></p>{{end}}
+{{if .Message}}<pre>{{.Message}}</pre>{{end}}
+<hr><address>mallory</address>
+</body>
+</html>
+`
+
+var pageExplain = map[string]string{
+	PageUnreachable: "The proxy could not reach the destination server.",
+	PageQuota:       "The proxy is over its quota, please try again later.",
+	PageBlocked:     "Access to this host is not allowed by the proxy.",
+	PageAuth:        "The proxy requires authentication.",
+	PageTooLarge:    "The request body is larger than the proxy accepts.",
+	PageBusy:        "The proxy is too busy, please try again later.",
+	PageMethod:      "The request method is not allowed by the proxy.",
+	PageLoop:        "The request went through this proxy before, the proxies are configured in a loop.",
+	PageMaintenance: "The proxy is down for maintenance, please try again later.",
+	PageError:       "The proxy failed to handle the request.",
+}
+
+// data passed to the error templates
+type ErrorPage struct {
+	Class      string
+	Status     int
+	StatusText string
+	Explain    string
+	Host       string
+	Message    string
+}
+
+// HTML error pages for the failure classes, a nil *ErrorPages writes plain text errors
+type ErrorPages struct {
+	tmpl map[string]*template.Template
+}
+
+// Load templates named <class>.html from dir, missing ones use the built-in page.
+// An empty dir only uses the built-in pages.
+func NewErrorPages(dir string) (self *ErrorPages, err error) {
+	self = &ErrorPages{tmpl: make(map[string]*template.Template)}
+	def := template.Must(template.New("default").Parse(defaultPage))
+	for class := range pageStatus {
+		self.tmpl[class] = def
+		if dir == "" {
+			continue
+		}
+		path := filepath.Join(os.ExpandEnv(dir), class+".html")
+		if _, serr := os.Stat(path); serr != nil {
+			continue
+		}
+		t, err := template.ParseFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		self.tmpl[class] = t
+	}
+	return
+}
+
+// Write the page of the error class, see PageOf
+func (self *ErrorPages) WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	self.Write(w, r, PageOf(err), err.Error())
+}
+
+// Write the page of the class with its status code to w
+func (self *ErrorPages) Write(w http.ResponseWriter, r *http.Request, class, msg string) {
+	status, ok := pageStatus[class]
+	if !ok {
+		class, status = PageError, pageStatus[PageError]
+	}
+	if self == nil {
+		http.Error(w, msg, status)
+		return
+	}
+	page := &ErrorPage{
+		Class:      class,
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Explain:    pageExplain[class],
+		Host:       r.URL.Host,
+		Message:    msg,
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := self.tmpl[class].Execute(w, page); err != nil {
+		L.Printf("Execute %s page: %s\n", class, err)
+	}
+}
@@ -0,0 +1,99 @@
+package mallory
+
+import (
+	"errors"
+	"net"
+	"net/http"
+)
+
+var (
+	// the direct connection timed out, retry through the remote server
+	ErrShouldProxy = errors.New("should proxy")
+	// failed to connect the destination or the remote server
+	ErrBackendUnreachable = errors.New("backend unreachable")
+	// failed to set up the SSH session with the remote server
+	ErrHandshake = errors.New("handshake failed")
+	// the request is not allowed by the proxy
+	ErrBlockedHost = errors.New("blocked host")
+	// the proxy is over its quota
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// the method is not in allowed_methods
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	// the request went through this mallory before
+	ErrLoopDetected = errors.New("proxy loop detected")
+	// too many concurrent requests
+	ErrOverloaded = errors.New("too many requests in flight")
+	// the proxy is in maintenance mode
+	ErrMaintenance = errors.New("in maintenance")
+	// the request body is larger than max_request_body
+	ErrTooLarge = errors.New("request body too large")
+	// mallory itself failed, e.g. a panic of a handler
+	ErrInternal = errors.New("internal error")
+)
+
+// Error is a failure of Op, classified by Kind which is one of the Err* above.
+// Use errors.Is(err, ErrBackendUnreachable) etc. to test the class.
+type Error struct {
+	Kind error
+	Op   string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Op + ": " + e.Kind.Error()
+	}
+	return e.Op + ": " + e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+// err of op as ErrBackendUnreachable, unless it is classified already
+func classify(err error, op string) error {
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	// body cut by http.MaxBytesReader, the client sent too much
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return &Error{Kind: ErrTooLarge, Op: op, Err: err}
+	}
+	return &Error{Kind: ErrBackendUnreachable, Op: op, Err: err}
+}
+
+// timeout error from net package or not
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// page class of the error
+func PageOf(err error) string {
+	switch {
+	case errors.Is(err, ErrBackendUnreachable), errors.Is(err, ErrHandshake):
+		return PageUnreachable
+	case errors.Is(err, ErrBlockedHost):
+		return PageBlocked
+	case errors.Is(err, ErrQuotaExceeded):
+		return PageQuota
+	case errors.Is(err, ErrTooLarge):
+		return PageTooLarge
+	case errors.Is(err, ErrMethodNotAllowed):
+		return PageMethod
+	case errors.Is(err, ErrLoopDetected):
+		return PageLoop
+	case errors.Is(err, ErrOverloaded):
+		return PageBusy
+	case errors.Is(err, ErrMaintenance):
+		return PageMaintenance
+	default:
+		return PageError
+	}
+}
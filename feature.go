@@ -0,0 +1,41 @@
+package mallory
+
+import "sort"
+
+// Experimental features, enabled in the features map of config file.
+const (
+	// share one fetch between concurrent identical GETs
+	FeatureCoalesce = "coalesce"
+	// relay 1xx informational responses like 103 Early Hints
+	FeatureEarlyHints = "early_hints"
+)
+
+var knownFeatures = map[string]bool{
+	FeatureCoalesce:   true,
+	FeatureEarlyHints: true,
+}
+
+// test whether the experimental feature is enabled or not
+func (self *ConfigFile) Feature(name string) bool {
+	return self.Features[name]
+}
+
+// names of the enabled features, sorted
+func (self *ConfigFile) EnabledFeatures() (names []string) {
+	for name, on := range self.Features {
+		if on {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// warn unknown names of features
+func (self *ConfigFile) loadFeatures() {
+	for name := range self.Features {
+		if !knownFeatures[name] {
+			L.Printf("Unknown feature %q\n", name)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package mallory
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// summary of one proxied request or CONNECT tunnel
+type FlowRecord struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	Host       string    `json:"host"`
+	Method     string    `json:"method"`
+	Engine     string    `json:"engine"`
+	BytesUp    int64     `json:"bytes_up"`
+	BytesDown  int64     `json:"bytes_down"`
+	DurationMS int64     `json:"duration_ms"`
+	Status     int       `json:"status"`
+}
+
+// Writer of flow records as JSON lines, a nil *FlowLog writes nothing
+type FlowLog struct {
+	mutex sync.Mutex
+	w     io.WriteCloser
+}
+
+// Open the sink of flow records, one of
+//   - stdout
+//   - udp://host:port, one record per datagram
+//   - path of a file to append to
+//
+// An empty sink returns nil.
+func NewFlowLog(sink string) (*FlowLog, error) {
+	var w io.WriteCloser
+	var err error
+	switch {
+	case sink == "":
+		return nil, nil
+	case sink == "stdout":
+		w = os.Stdout
+	case strings.HasPrefix(sink, "udp://"):
+		w, err = net.Dial("udp", strings.TrimPrefix(sink, "udp://"))
+	default:
+		w, err = os.OpenFile(os.ExpandEnv(sink), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &FlowLog{w: w}, nil
+}
+
+// Write the record of r handled by the engine
+func (self *FlowLog) Write(r *http.Request, engine string, status int, up, down int64, start time.Time) {
+	if self == nil {
+		return
+	}
+	buf, err := json.Marshal(&FlowRecord{
+		Time:       start,
+		Client:     r.RemoteAddr,
+		Host:       r.URL.Host,
+		Method:     r.Method,
+		Engine:     engine,
+		BytesUp:    up,
+		BytesDown:  down,
+		DurationMS: time.Since(start).Milliseconds(),
+		Status:     status,
+	})
+	if err != nil {
+		L.Printf("FlowLog: %s\n", err)
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if _, err = self.w.Write(append(buf, '\n')); err != nil {
+		L.Printf("FlowLog: %s\n", err)
+	}
+}
+
+// engine of the records of requests rejected by mallory itself
+const flowEngineLocal = "mallory"
+
+// request body counting the bytes read from the client, the transport may
+// still read it in its own goroutine
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+// count the body of r, nothing to count without a body
+func countBody(r *http.Request) *countingBody {
+	c := &countingBody{ReadCloser: r.Body}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = c
+	}
+	return c
+}
+
+func (self *countingBody) Read(p []byte) (int, error) {
+	n, err := self.ReadCloser.Read(p)
+	atomic.AddInt64(&self.n, int64(n))
+	return n, err
+}
+
+// bytes read so far
+func (self *countingBody) N() int64 {
+	return atomic.LoadInt64(&self.n)
+}
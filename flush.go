@@ -0,0 +1,113 @@
+package mallory
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// latencyWriter flushes at most latency after a write, or once unflushed bytes
+// reach max. A negative latency flushes after each write.
+type latencyWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	f       http.Flusher
+	latency time.Duration
+	max     int
+	pending int
+	t       *time.Timer
+	stopped bool
+	// write a comment line after keepAlive without data, for event streams
+	keepAlive time.Duration
+	ka        *time.Timer
+	// the last write ended a line, or nothing is written
+	lineStart bool
+}
+
+func (self *latencyWriter) Write(p []byte) (n int, err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	n, err = self.w.Write(p)
+	self.pending += n
+	if n > 0 {
+		self.lineStart = p[n-1] == '\n'
+	}
+	if self.ka != nil {
+		self.ka.Reset(self.keepAlive)
+	}
+	if self.latency < 0 || (self.max > 0 && self.pending >= self.max) {
+		self.f.Flush()
+		self.pending = 0
+		return
+	}
+	if self.latency > 0 && self.t == nil {
+		self.t = time.AfterFunc(self.latency, self.delayedFlush)
+	}
+	return
+}
+
+func (self *latencyWriter) delayedFlush() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if !self.stopped && self.pending > 0 {
+		self.f.Flush()
+	}
+	self.pending = 0
+	self.t = nil
+}
+
+// Send an SSE comment line to keep the idle stream open through
+// intermediaries. Only at a line start, a comment never splits a field.
+func (self *latencyWriter) ping() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.stopped {
+		return
+	}
+	if self.lineStart {
+		if _, err := self.w.Write([]byte(":\n")); err != nil {
+			return
+		}
+		self.f.Flush()
+	}
+	self.ka.Reset(self.keepAlive)
+}
+
+// no more flushes, call it before the handler returns
+func (self *latencyWriter) stop() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.stopped = true
+	if self.t != nil {
+		self.t.Stop()
+	}
+	if self.ka != nil {
+		self.ka.Stop()
+	}
+}
+
+// writer flushing the response of resp as FlushInterval and FlushBytes,
+// event streams are flushed at once and kept alive as StreamKeepAlive,
+// nil if no need to flush.
+func (self *Direct) streamWriter(w http.ResponseWriter, resp *http.Response) *latencyWriter {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return nil
+	}
+	latency := self.FlushInterval
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if ct == "text/event-stream" {
+		latency = -1
+	}
+	if latency == 0 && self.FlushBytes <= 0 {
+		return nil
+	}
+	lw := &latencyWriter{w: w, f: f, latency: latency, max: self.FlushBytes, lineStart: true}
+	if ct == "text/event-stream" && self.StreamKeepAlive > 0 {
+		lw.keepAlive = self.StreamKeepAlive
+		lw.ka = time.AfterFunc(lw.keepAlive, lw.ping)
+	}
+	return lw
+}
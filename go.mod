@@ -1,6 +1,6 @@
 module github.com/justmao945/mallory
 
-go 1.17
+go 1.20
 
 require (
 	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
@@ -11,4 +11,5 @@ require (
 require (
 	github.com/fsnotify/fsnotify v1.5.4 // indirect
 	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad // indirect
+	golang.org/x/text v0.3.7 // indirect
 )
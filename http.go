@@ -2,8 +2,11 @@ package mallory
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 // HostOnly returns host if has port in addr, or addr if missing port
@@ -53,7 +56,85 @@ var hopHeaders = []string{
 }
 
 func RemoveHopHeaders(h http.Header) {
+	// headers listed in Connection are hop-by-hop too, e.g. Keep-Alive of HTTP/1.0
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
 	for _, k := range hopHeaders {
 		h.Del(k)
 	}
 }
+
+// RemoveHopHeaders but keep the headers in preserve
+func RemoveHopHeadersExcept(h http.Header, preserve []string) {
+	kept := make(http.Header)
+	for _, k := range preserve {
+		if vs, ok := h[http.CanonicalHeaderKey(k)]; ok {
+			kept[http.CanonicalHeaderKey(k)] = vs
+		}
+	}
+	RemoveHopHeaders(h)
+	for k, vs := range kept {
+		h[k] = vs
+	}
+}
+
+// flushWriter flushes after each write, data is sent to the client at once
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (self *flushWriter) Write(p []byte) (n int, err error) {
+	n, err = self.w.Write(p)
+	self.f.Flush()
+	return
+}
+
+// Remove existing Via of h if strip, and append "<major>.<minor> <pseudonym>" if pseudonym is not empty
+func SetVia(h http.Header, major, minor int, pseudonym string, strip bool) {
+	if strip {
+		h.Del("Via")
+	}
+	if pseudonym != "" {
+		h.Add("Via", fmt.Sprintf("%d.%d %s", major, minor, pseudonym))
+	}
+}
+
+// Rebuild the absolute URL of a plain request from an HTTP/2 client, r.URL
+// only has the :path, and the destination is r.Host from :authority. Requests
+// to mallory itself, e.g. /status, are left as is.
+func AbsoluteURL(r *http.Request) {
+	if r.ProtoMajor != 2 || r.Method == "CONNECT" || r.URL.IsAbs() || r.Host == "" || r.RequestURI == "*" {
+		return
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && isSelf(addr, r.Host) {
+		return
+	}
+	r.URL.Scheme = "http"
+	r.URL.Host = r.Host
+}
+
+// StripFragment removes the #fragment of u, which is only for clients.
+// The request line is parsed without fragments, so it is still in the query
+// or path, and would be sent as %23 to the server. Only a literal '#' is a
+// fragment, an escaped %23 is part of the path or query.
+func StripFragment(u *url.URL) {
+	if i := strings.IndexByte(u.RawQuery, '#'); i >= 0 {
+		u.RawQuery = u.RawQuery[:i]
+	} else if i := strings.IndexByte(u.RawPath, '#'); i >= 0 {
+		// a literal '#' is only seen in RawPath, Path has %23 decoded too
+		if p, err := url.PathUnescape(u.RawPath[:i]); err == nil {
+			u.Path = p
+			u.RawPath = u.RawPath[:i]
+		}
+		// e.g. /p#frag?x=1, the query is part of the fragment
+		u.RawQuery = ""
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+}
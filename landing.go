@@ -0,0 +1,37 @@
+package mallory
+
+import (
+	"html/template"
+	"net/http"
+)
+
+var landingPage = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>mallory</title></head>
+<body>
+<h1>mallory</h1>
+<p>This is an HTTP proxy, not a web site.</p>
+<p>To use it, set <code>{{.}}</code> as the HTTP and HTTPS proxy of your browser or system,
+or <code>export http_proxy=http://{{.}} https_proxy=http://{{.}}</code> in a terminal.</p>
+<hr><address>{{.}}</address>
+</body>
+</html>
+`))
+
+// Response to requests for the proxy itself, e.g. from a browser opening the
+// proxy address as a web site. A landing page if landing_page is set, or 400.
+func (self *Server) landing(w http.ResponseWriter, r *http.Request) {
+	// HTTP/1.0 clients may not send Host
+	host := r.Host
+	if host == "" {
+		host = "host:port of mallory"
+	}
+	if !self.Cfg.Current().LandingPage {
+		http.Error(w, "This is an HTTP proxy, set "+host+" as the proxy of your client", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := landingPage.Execute(w, host); err != nil {
+		L.Printf("Execute landing page: %s\n", err)
+	}
+}
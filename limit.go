@@ -0,0 +1,94 @@
+package mallory
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Limit of concurrent proxied requests shared by servers, a request waits at
+// most Timeout for a free slot. CONNECT tunnels hold their slot until closed.
+// No limit if nil.
+type Limiter struct {
+	// longest wait for a free slot
+	Timeout   time.Duration
+	slots     chan struct{}
+	bulkSlots chan struct{}
+	queued    int64
+}
+
+// Limit to max requests, reserved of them for interactive requests only,
+// bulk ones wait when the others are in use. Nil if max is 0.
+func NewLimiter(max, reserved int, timeout time.Duration) *Limiter {
+	if max <= 0 {
+		return nil
+	}
+	self := &Limiter{Timeout: timeout, slots: make(chan struct{}, max)}
+	if reserved > 0 && reserved < max {
+		self.bulkSlots = make(chan struct{}, max-reserved)
+	}
+	return self
+}
+
+// number of requests waiting for a free slot
+func (self *Limiter) QueueDepth() int64 {
+	if self == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&self.queued)
+}
+
+// wait for a free slot, false if timed out or the client is gone.
+// A bulk request takes a bulk slot first, so it never uses the reserved ones.
+func (self *Limiter) acquire(r *http.Request, bulk bool) bool {
+	if self == nil {
+		return true
+	}
+	if bulk && self.bulkSlots != nil {
+		if !self.wait(r, self.bulkSlots) {
+			return false
+		}
+		if !self.wait(r, self.slots) {
+			<-self.bulkSlots
+			return false
+		}
+		return true
+	}
+	return self.wait(r, self.slots)
+}
+
+// wait for a free slot of slots
+func (self *Limiter) wait(r *http.Request, slots chan struct{}) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if self.Timeout <= 0 {
+		return false
+	}
+
+	atomic.AddInt64(&self.queued, 1)
+	defer atomic.AddInt64(&self.queued, -1)
+
+	timer := time.NewTimer(self.Timeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (self *Limiter) release(bulk bool) {
+	if self == nil {
+		return
+	}
+	<-self.slots
+	if bulk && self.bulkSlots != nil {
+		<-self.bulkSlots
+	}
+}
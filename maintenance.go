@@ -0,0 +1,90 @@
+package mallory
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Turn maintenance mode on or off at runtime, for all servers of the config.
+// It is also on if maintenance is set in config file.
+func (self *Config) SetMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&self.maintenance, v)
+}
+
+// test whether maintenance mode is on or not
+func (self *Config) Maintenance() bool {
+	return atomic.LoadInt32(&self.maintenance) == 1 || self.Current().Maintenance
+}
+
+// test whether r is rejected by maintenance mode or not,
+// clients in maintenance_allow bypass it.
+func (self *Server) inMaintenance(r *http.Request) bool {
+	if !self.Cfg.Maintenance() {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return !containsIP(self.Cfg.Current().MaintenanceNets(), net.ParseIP(host))
+}
+
+// reject r with 503 and Retry-After
+func (self *Server) writeMaintenance(w http.ResponseWriter, r *http.Request, start time.Time) {
+	err := &Error{Kind: ErrMaintenance, Op: r.Method + " " + r.RequestURI}
+	L.Println(err)
+	if s := self.Cfg.Current().MaintenanceRetryAfterS; s > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(s))
+	}
+	self.reject(w, r, err, start)
+}
+
+// header required to change the maintenance mode, browsers do not send it
+// to another origin without a preflight, which mallory never answers
+const maintenanceHeader = "X-Mallory-Maintenance"
+
+// GET /maintenance shows the mode, POST /maintenance?on=true or ?on=false
+// turns it on or off, only from this host and with maintenanceHeader.
+// Requests from web pages, with Origin or Sec-Fetch-Site, are rejected.
+func (self *Server) maintenanceEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "maintenance can only be changed from localhost", http.StatusForbidden)
+			return
+		}
+		if site := r.Header.Get("Sec-Fetch-Site"); r.Header.Get("Origin") != "" || (site != "" && site != "none") {
+			http.Error(w, "maintenance can not be changed by web pages", http.StatusForbidden)
+			return
+		}
+		if r.Header.Get(maintenanceHeader) == "" {
+			http.Error(w, "maintenance can only be changed with "+maintenanceHeader, http.StatusForbidden)
+			return
+		}
+		on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+		if err != nil {
+			http.Error(w, "on: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		self.Cfg.SetMaintenance(on)
+		L.Printf("Maintenance mode set to %v\n", on)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, r.Method+" not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if self.Cfg.Maintenance() {
+		w.Write([]byte("maintenance on\n"))
+	} else {
+		w.Write([]byte("maintenance off\n"))
+	}
+}
@@ -0,0 +1,648 @@
+package mallory
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/http2"
+)
+
+// config loaded from a file of content
+func testConfig(t *testing.T, content string) *Config {
+	path := filepath.Join(t.TempDir(), "mallory.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// parent proxy fetching everything directly, like the remote end of SSH
+func testParent(t *testing.T) *httptest.Server {
+	c := testConfig(t, `{"remote": "ssh://nobody@127.0.0.1:1", "instance_id": "parent"}`)
+	parent := httptest.NewServer(&Server{
+		Mode:         NormalSrv,
+		Cfg:          c,
+		Direct:       NewDirect(0),
+		Remote:       NewDirect(0),
+		BlockedHosts: make(map[string]bool),
+	})
+	t.Cleanup(parent.Close)
+	return parent
+}
+
+// mallory in normal mode chained to remote
+func testProxy(t *testing.T, remote string) *httptest.Server {
+	ts := httptest.NewUnstartedServer(nil)
+	if remote == "" {
+		// chained to itself
+		remote = "http://" + ts.Listener.Addr().String()
+	}
+	c := testConfig(t, fmt.Sprintf(`{"remote": %q, "instance_id": "proxy"}`, remote))
+	srv, err := NewServer(NormalSrv, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Config.Handler = srv
+	ts.Config.DisableGeneralOptionsHandler = true
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// client through proxy, trusting the certificate of origin if not nil
+func testClient(t *testing.T, proxy *httptest.Server, origin *httptest.Server) *http.Client {
+	u, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &http.Transport{Proxy: http.ProxyURL(u)}
+	if origin != nil {
+		tr.TLSClientConfig = origin.Client().Transport.(*http.Transport).TLSClientConfig
+	}
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr}
+}
+
+func testGet(t *testing.T, cli *http.Client, url string) (int, string) {
+	resp, err := cli.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer origin.Close()
+	tlsOrigin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "secure %s", r.URL.Path)
+	}))
+	defer tlsOrigin.Close()
+
+	proxy := testProxy(t, testParent(t).URL)
+	cli := testClient(t, proxy, tlsOrigin)
+
+	if code, body := testGet(t, cli, origin.URL+"/plain"); code != 200 || body != "hello /plain" {
+		t.Errorf("GET: %d %q", code, body)
+	}
+	// CONNECT to the TLS origin, then GET in the tunnel
+	if code, body := testGet(t, cli, tlsOrigin.URL+"/tunnel"); code != 200 || body != "secure /tunnel" {
+		t.Errorf("CONNECT: %d %q", code, body)
+	}
+}
+
+func TestLoopDetected(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("looped request reached the origin")
+	}))
+	defer origin.Close()
+
+	proxy := testProxy(t, "")
+	cli := testClient(t, proxy, nil)
+
+	if code, _ := testGet(t, cli, origin.URL); code != http.StatusLoopDetected {
+		t.Errorf("GET: %d, want %d", code, http.StatusLoopDetected)
+	}
+}
+
+func TestAbortMidBody(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("truncated"))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer origin.Close()
+
+	proxy := testProxy(t, testParent(t).URL)
+	cli := testClient(t, proxy, nil)
+
+	// the connection is closed, before or after the headers reached the client
+	resp, err := cli.Get(origin.URL)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if body, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Errorf("truncated body %q read as complete", body)
+	}
+}
+
+func TestOptionsAsterisk(t *testing.T) {
+	proxy := testProxy(t, testParent(t).URL)
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "OPTIONS * HTTP/1.1\r\nHost: mallory\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Allow") == "" {
+		t.Errorf("OPTIONS *: %d, Allow %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
+
+func TestStripFragment(t *testing.T) {
+	for uri, want := range map[string]string{
+		"http://h/p#frag?x=1":       "http://h/p",
+		"http://h/p?x=1#frag":       "http://h/p?x=1",
+		"http://h/files/C%23/notes": "http://h/files/C%23/notes",
+		"http://h/a%23b?x=1":        "http://h/a%23b?x=1",
+		"http://h/C%23/n#frag":      "http://h/C%23/n",
+		"http://h/a?q=%23x":         "http://h/a?q=%23x",
+		"http://h/a?q=%23x#frag":    "http://h/a?q=%23x",
+	} {
+		r, err := http.ReadRequest(bufio.NewReader(strings.NewReader("GET " + uri + " HTTP/1.1\r\nHost: h\r\n\r\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		StripFragment(r.URL)
+		if got := r.URL.String(); got != want {
+			t.Errorf("%s: %s, want %s", uri, got, want)
+		}
+	}
+}
+
+func TestDefaultRetryMethods(t *testing.T) {
+	if _, err := ParseConfigFile("mallory.json", []byte(`{"remote": "ssh://nobody@127.0.0.1:1", "retry_methods": ["POST"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if m := DefaultConfigFile().RetryMethods; m[0] != "GET" {
+		t.Errorf("default retry_methods changed by a config: %v", m)
+	}
+	if m := NewDirect(0).RetryMethods; m[0] != "GET" {
+		t.Errorf("retry methods of direct changed by a config: %v", m)
+	}
+}
+
+func TestIsListener(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	for host, want := range map[string]bool{
+		"127.0.0.1:" + port:   true,
+		"[::1]:" + port:       true,
+		"127.0.0.1:1":         false,
+		"203.0.113.1:" + port: false,
+	} {
+		if got := isListener(l, host); got != want {
+			t.Errorf("%s of %s: %v, want %v", host, l.Addr(), got, want)
+		}
+	}
+}
+
+func TestHTTP2Client(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer origin.Close()
+
+	ts := httptest.NewUnstartedServer(nil)
+	srv, err := NewServer(NormalSrv, testConfig(t, fmt.Sprintf(`{"remote": %q, "instance_id": "proxy"}`, testParent(t).URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Config.Handler = srv
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	// like a browser with an HTTPS proxy, plain requests are streams on the
+	// connection to mallory
+	cfg := ts.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	cfg.NextProtos = []string{"h2"}
+	tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return tls.Dial(network, ts.Listener.Addr().String(), cfg)
+		},
+	}
+	defer tr.CloseIdleConnections()
+	cli := &http.Client{Transport: tr}
+
+	if code, body := testGet(t, cli, origin.URL+"/h2"); code != 200 || body != "hello /h2" {
+		t.Errorf("GET: %d %q", code, body)
+	}
+	if code, body := testGet(t, cli, "http://"+ts.Listener.Addr().String()+"/status"); code != 200 || !strings.HasPrefix(body, "connections") {
+		t.Errorf("status: %d %q", code, body)
+	}
+}
+
+func TestCoalescePrivate(t *testing.T) {
+	for header, shared := range map[string]bool{
+		"":                        true,
+		"Set-Cookie":              false,
+		"Cache-Control: private":  false,
+		"Cache-Control: no-store": false,
+	} {
+		var hits int32
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&hits, 1)
+			switch header {
+			case "Set-Cookie":
+				w.Header().Set("Set-Cookie", fmt.Sprintf("session=%d", n))
+			case "":
+			default:
+				w.Header().Set("Cache-Control", strings.TrimPrefix(header, "Cache-Control: "))
+			}
+			// the others join while this one is fetched
+			time.Sleep(300 * time.Millisecond)
+			fmt.Fprint(w, n)
+		}))
+
+		d := NewDirect(0)
+		d.Coalesce = true
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r, _ := http.NewRequest("GET", origin.URL, nil)
+				resp, err := d.roundTrip(r)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+			}()
+		}
+		wg.Wait()
+		origin.Close()
+
+		if got := atomic.LoadInt32(&hits) == 1; got != shared {
+			t.Errorf("%q: %d fetches for 3 requests", header, hits)
+		}
+	}
+}
+
+func TestMaintenanceEndpoint(t *testing.T) {
+	c := testConfig(t, `{"remote": "ssh://nobody@127.0.0.1:1"}`)
+	srv := &Server{Mode: NormalSrv, Cfg: c, Direct: NewDirect(0), Remote: NewDirect(0), BlockedHosts: make(map[string]bool)}
+
+	post := func(remote string, header http.Header) int {
+		r := httptest.NewRequest("POST", "/maintenance?on=true", nil)
+		r.RemoteAddr = remote
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		return w.Code
+	}
+	admin := http.Header{maintenanceHeader: {"1"}}
+	for name, code := range map[string]int{
+		"remote":         post("192.0.2.1:1234", admin),
+		"no header":      post("127.0.0.1:1234", nil),
+		"origin":         post("127.0.0.1:1234", http.Header{maintenanceHeader: {"1"}, "Origin": {"http://evil.example"}}),
+		"sec-fetch-site": post("127.0.0.1:1234", http.Header{maintenanceHeader: {"1"}, "Sec-Fetch-Site": {"cross-site"}}),
+	} {
+		if code != http.StatusForbidden {
+			t.Errorf("%s: %d, want 403", name, code)
+		}
+		if c.Maintenance() {
+			t.Fatalf("%s: maintenance turned on", name)
+		}
+	}
+	if code := post("127.0.0.1:1234", admin); code != 200 || !c.Maintenance() {
+		t.Errorf("local: %d, maintenance %v", code, c.Maintenance())
+	}
+}
+
+func TestKeepAliveRouting(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	c := testConfig(t, fmt.Sprintf(`{"remote": %q, "instance_id": "proxy", "add_engine_header": true, "blocked": ["localhost"]}`, testParent(t).URL))
+	srv, err := NewServer(SmartSrv, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(srv)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	// the same origin by two names, only localhost is blocked
+	for host, engine := range map[string]string{"127.0.0.1": "direct", "localhost": "chain"} {
+		fmt.Fprintf(conn, "GET http://%s:%s/ HTTP/1.1\r\nHost: %s:%s\r\n\r\n", host, port, host, port)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Mallory-Engine"); resp.StatusCode != 200 || got != engine {
+			t.Errorf("%s: %d via %q, want %s", host, resp.StatusCode, got, engine)
+		}
+	}
+}
+
+// engine panicking on /panic, like a nil deref on a malformed request
+type panicTransport struct {
+	next http.RoundTripper
+}
+
+func (self panicTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Path == "/panic" {
+		var resp *http.Response
+		return resp, fmt.Errorf("%d", resp.StatusCode)
+	}
+	return self.next.RoundTrip(r)
+}
+
+func TestPanicRecovered(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer origin.Close()
+
+	proxy := testProxy(t, testParent(t).URL)
+	srv := proxy.Config.Handler.(*Server)
+	srv.Remote.Transport = panicTransport{srv.Remote.Tr}
+	cli := testClient(t, proxy, nil)
+
+	if code, _ := testGet(t, cli, origin.URL+"/panic"); code != http.StatusInternalServerError {
+		t.Errorf("panic: %d, want 500", code)
+	}
+	// still serving
+	if code, body := testGet(t, cli, origin.URL+"/ok"); code != 200 || body != "hello /ok" {
+		t.Errorf("after panic: %d %q", code, body)
+	}
+}
+
+// send the raw request to proxy, the response body is read
+func testRaw(t *testing.T, proxy *httptest.Server, req string) (*http.Response, string) {
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprint(conn, req)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+func TestMissingHost(t *testing.T) {
+	proxy := testProxy(t, testParent(t).URL)
+
+	resp, body := testRaw(t, proxy, "GET http:///path HTTP/1.0\r\n\r\n")
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "missing host") {
+		t.Errorf("GET http:///path: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestConnectResponse(t *testing.T) {
+	origin := httptest.NewServer(http.NotFoundHandler())
+	defer origin.Close()
+	host := origin.Listener.Addr().String()
+	proxy := testProxy(t, testParent(t).URL)
+	remote := proxy.Config.Handler.(*Server).Remote
+
+	for _, agent := range []string{"", "mallory"} {
+		remote.ProxyAgent = agent
+		for _, proto := range []string{"HTTP/1.0", "HTTP/1.1"} {
+			conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(conn, "CONNECT %s %s\r\nHost: %s\r\n\r\n", host, proto, host)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+			conn.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != 200 || resp.Proto != proto || resp.Header.Get("Proxy-Agent") != agent {
+				t.Errorf("%s with agent %q: %s %s, Proxy-Agent %q", proto, agent, resp.Proto, resp.Status, resp.Header.Get("Proxy-Agent"))
+			}
+		}
+	}
+}
+
+func TestHTTP10Client(t *testing.T) {
+	// chunked to mallory, no Content-Length
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello "))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("world"))
+	}))
+	defer origin.Close()
+	proxy := testProxy(t, testParent(t).URL)
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.0\r\n\r\n", origin.URL)
+
+	// the body ends when the connection is closed
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("connection not closed: %s", err)
+	}
+	if len(resp.TransferEncoding) > 0 || string(body) != "hello world" {
+		t.Errorf("HTTP/1.0: %v %q", resp.TransferEncoding, body)
+	}
+}
+
+func TestFlowLog(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer origin.Close()
+
+	path := filepath.Join(t.TempDir(), "flows.jsonl")
+	c := testConfig(t, fmt.Sprintf(`{"remote": %q, "instance_id": "proxy", "flow_log": %q}`, testParent(t).URL, path))
+	srv, err := NewServer(NormalSrv, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(srv)
+	defer proxy.Close()
+	cli := testClient(t, proxy, nil)
+
+	// chunked upload without Content-Length
+	resp, err := cli.Post(origin.URL, "text/plain", io.MultiReader(strings.NewReader(strings.Repeat("x", 1000))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// fails to connect the destination
+	testGet(t, cli, "http://127.0.0.1:1/")
+	// rejected by mallory itself
+	req, _ := http.NewRequest("TRACE", origin.URL, nil)
+	if resp, err = cli.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []FlowRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		var rec FlowRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("%q: %s", line, err)
+		}
+		got = append(got, rec)
+	}
+	want := []FlowRecord{
+		{Method: "POST", Engine: "chain", Status: 200, BytesUp: 1000},
+		{Method: "GET", Engine: "chain", Status: http.StatusBadGateway},
+		{Method: "TRACE", Engine: "mallory", Status: http.StatusMethodNotAllowed},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%d records, want %d: %s", len(got), len(want), buf)
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Method != w.Method || g.Engine != w.Engine || g.Status != w.Status || g.BytesUp != w.BytesUp {
+			t.Errorf("record %d: %+v, want %+v", i, g, w)
+		}
+	}
+}
+
+// DNS server on UDP answering A queries with ip, or never if ip is nil
+func testDNS(t *testing.T, ip net.IP) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil || ip == nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true})
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			if q.Type == dnsmessage.TypeA {
+				var a [4]byte
+				copy(a[:], ip.To4())
+				b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: a})
+			}
+			msg, _ := b.Finish()
+			pc.WriteTo(msg, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestResolverFailover(t *testing.T) {
+	want := net.ParseIP("192.0.2.1")
+	r, err := NewResolver([]string{testDNS(t, nil), testDNS(t, want)}, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Timeout = 200 * time.Millisecond
+
+	// each server comes first once
+	for i := 0; i < 2; i++ {
+		addrs, err := r.LookupIPAddr(context.Background(), "mallory.test.")
+		if err != nil {
+			t.Fatalf("lookup %d: %s", i, err)
+		}
+		if len(addrs) != 1 || !addrs[0].IP.Equal(want) {
+			t.Errorf("lookup %d: %v, want %s", i, addrs, want)
+		}
+	}
+
+	// direct requests dial the resolved address
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+	r, err = NewResolver([]string{testDNS(t, nil), testDNS(t, net.ParseIP("127.0.0.1"))}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Timeout = 100 * time.Millisecond
+	d := NewDirect(time.Second)
+	d.Tr.DialContext = r.Dial(d.Dialer)
+	defer d.Tr.CloseIdleConnections()
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "http://mallory.test.:"+port+"/", nil)
+		resp, err := d.Tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("GET %d: %s", i, err)
+		}
+		resp.Body.Close()
+		// a new connection, and a new lookup, each time
+		d.Tr.CloseIdleConnections()
+	}
+
+	if _, err := NewResolver([]string{"127.0.0.1:53"}, "192.0.2.55"); err == nil {
+		t.Error("source IP not of this host is accepted")
+	}
+}
@@ -0,0 +1,109 @@
+package mallory
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errConfigUnchanged = errors.New("config unchanged")
+
+// largest config fetched from URL
+const maxConfigSize = 1 << 20
+
+// test whether path is an http(s) URL of config file or not
+func isConfigURL(path string) bool {
+	return strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://")
+}
+
+// fetch config file from url, certificates of https are verified
+func fetchConfig(url string) ([]byte, error) {
+	cli := &http.Client{Timeout: 30 * time.Second}
+	resp, err := cli.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	buf, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: maxConfigSize + 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > maxConfigSize {
+		return nil, fmt.Errorf("GET %s: larger than %s", url, BeautifySize(maxConfigSize))
+	}
+	return buf, nil
+}
+
+// path of the last good config fetched from URL
+func (self *Config) cachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(self.Path))
+	return filepath.Join(dir, "mallory", "config-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// last good config fetched from URL, empty if none
+func (self *Config) readCache() []byte {
+	buf, err := ioutil.ReadFile(self.cachePath())
+	if err != nil {
+		L.Printf("Read cached config: %s\n", err)
+	}
+	return buf
+}
+
+// Load the config file, or fetch and check the config from URL and cache it
+// as the last good one. errConfigUnchanged if it is the same as last time.
+func (self *Config) readFile() (*ConfigFile, error) {
+	if !isConfigURL(self.Path) {
+		return NewConfigFile(self.Path)
+	}
+	self.fetchedMutex.Lock()
+	defer self.fetchedMutex.Unlock()
+	buf, err := fetchConfig(self.Path)
+	if err != nil {
+		return nil, err
+	}
+	if self.fetched != nil && bytes.Equal(buf, self.fetched) {
+		return nil, errConfigUnchanged
+	}
+	file, err := ParseConfigFile(self.Path, buf)
+	if err != nil {
+		return nil, err
+	}
+	self.fetched = buf
+
+	path := self.cachePath()
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+		err = ioutil.WriteFile(path, buf, 0600)
+	}
+	if err != nil {
+		L.Printf("Cache config: %s\n", err)
+	}
+	return file, nil
+}
+
+// reload the config from URL every config_poll_ms, until it is 0
+func (self *Config) poll() {
+	for {
+		d := time.Millisecond * time.Duration(self.Current().ConfigPollMS)
+		if d <= 0 {
+			return
+		}
+		time.Sleep(d)
+		self.Reload()
+	}
+}
@@ -0,0 +1,87 @@
+package mallory
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// idempotent methods sent again by default, copied by users as json.Unmarshal
+// writes into the slice
+var defaultRetryMethods = []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE"}
+
+// requests safe to send again, with a method of RetryMethods or an
+// Idempotency-Key. The body can not be sent twice.
+func (self *Direct) retryable(r *http.Request) bool {
+	if r.Body != nil && r.Body != http.NoBody {
+		return false
+	}
+	if r.Header.Get("Idempotency-Key") != "" {
+		return true
+	}
+	for _, m := range self.RetryMethods {
+		if strings.EqualFold(m, r.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retry-After in seconds or HTTP date
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// Wait as 429 and 503 responses told by Retry-After, at most MaxRetryAfter,
+// and send r again once. The first response is returned if it fails again.
+func (self *Direct) retryAfter(r *http.Request, resp *http.Response) *http.Response {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return resp
+	}
+	if !self.retryable(r) {
+		return resp
+	}
+	wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		return resp
+	}
+	if wait > self.MaxRetryAfter {
+		wait = self.MaxRetryAfter
+	}
+	// do not retry at the same time with other clients
+	wait += time.Duration(rand.Int63n(int64(wait/4) + 1))
+
+	L.Printf("%s %s %s, retry after %s\n", r.Method, r.URL, resp.Status, BeautifyDuration(wait))
+	select {
+	case <-time.After(wait):
+	case <-r.Context().Done():
+		return resp
+	}
+
+	retry, err := self.roundTrip(r)
+	if err != nil {
+		L.Printf("RoundTrip: %s, retry failed\n", err.Error())
+		return resp
+	}
+	if retry.StatusCode == http.StatusTooManyRequests || retry.StatusCode == http.StatusServiceUnavailable {
+		L.Printf("%s %s %s again\n", r.Method, r.URL, retry.Status)
+		retry.Body.Close()
+		return resp
+	}
+	resp.Body.Close()
+	return retry
+}
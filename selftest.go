@@ -0,0 +1,33 @@
+package mallory
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// GET url through the remote server, to make sure it works before serving
+func (self *Server) SelfTest(url string) error {
+	start := time.Now()
+	cli := &http.Client{
+		Transport: self.Remote.transport(),
+		Timeout:   30 * time.Second,
+	}
+	resp, err := cli.Get(url)
+	if err != nil {
+		return &Error{Kind: ErrBackendUnreachable, Op: "self test " + url, Err: err}
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		return &Error{Kind: ErrBackendUnreachable, Op: "self test " + url, Err: err}
+	}
+	if resp.StatusCode >= 400 {
+		return &Error{Kind: ErrBackendUnreachable, Op: "self test " + url, Err: fmt.Errorf("got %s", resp.Status)}
+	}
+	L.Printf("Self test %s via %s %s in %s <-%s\n", url, self.Remote.Name, resp.Status,
+		BeautifyDuration(time.Since(start)), BeautifySize(n))
+	return nil
+}
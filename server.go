@@ -2,8 +2,17 @@
 package mallory
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/publicsuffix"
@@ -31,30 +40,111 @@ type Server struct {
 	Cfg *Config
 	// direct fetcher
 	Direct *Direct
-	// ssh fetcher, to connect remote proxy server
+	// ssh fetcher, to connect remote proxy server, nil if remote is a parent proxy
 	SSH *SSH
+	// chain fetcher, to connect a parent HTTP proxy, nil if remote is SSH
+	Chain *Chain
+	// fetcher of SSH or Chain
+	Remote *Direct
+	// error pages
+	Pages *ErrorPages
+	// summaries of requests rejected before a fetcher, none if nil
+	Flows *FlowLog
 	// a cache
 	BlockedHosts map[string]bool
+	// limit of concurrent requests, may be shared by servers
+	Limit *Limiter
+	// open client connections, shown by /status if set
+	Conns *ConnLimit
+	// middlewares and the handler wrapped by them
+	middlewares []Middleware
+	handler     http.Handler
 	// for serve http
 	mutex sync.RWMutex
 }
 
 // Create and intialize
 func NewServer(mode int, c *Config) (self *Server, err error) {
-	ssh, err := NewSSH(c)
+	pages, err := NewErrorPages(c.File.ErrorTemplateDir)
 	if err != nil {
 		return
 	}
 
 	shouldProxyTimeout := time.Millisecond * time.Duration(c.File.ShouldProxyTimeoutMS)
+	expectContinueTimeout := time.Millisecond * time.Duration(c.File.ExpectContinueTimeoutMS)
 
 	self = &Server{
 		Mode:         mode,
 		Cfg:          c,
 		Direct:       NewDirect(shouldProxyTimeout),
-		SSH:          ssh,
+		Pages:        pages,
 		BlockedHosts: make(map[string]bool),
 	}
+
+	// e.g. http://192.168.1.1:1316 or ssh://user@192.168.1.1:22
+	if strings.HasPrefix(c.File.RemoteServer, "http://") {
+		self.Chain, err = NewChain(c)
+		if err != nil {
+			return
+		}
+		self.Remote = self.Chain.Direct
+	} else {
+		self.SSH, err = NewSSH(c)
+		if err != nil {
+			return
+		}
+		self.Remote = self.SSH.Direct
+	}
+
+	if c.File.DialSourceIP != "" {
+		self.Direct.Dialer.LocalAddr, err = LocalAddr(c.File.DialSourceIP)
+		if err != nil {
+			return
+		}
+	}
+
+	// Dial of direct requests and tunnels,
+	// hosts dialed through the remote are resolved by the remote server.
+	if len(c.File.DNSServers) > 0 {
+		var resolver *Resolver
+		resolver, err = NewResolver(c.File.DNSServers, c.File.DialSourceIP)
+		if err != nil {
+			return
+		}
+		self.Direct.Tr.DialContext = resolver.Dial(self.Direct.Dialer)
+	}
+
+	flows, err := NewFlowLog(c.File.FlowLog)
+	if err != nil {
+		return
+	}
+
+	self.Flows = flows
+	self.Limit = NewLimiter(c.File.MaxConcurrent, c.File.QoSReserved, time.Millisecond*time.Duration(c.File.QueueTimeoutMS))
+
+	for _, d := range []*Direct{self.Direct, self.Remote} {
+		d.Pages = pages
+		d.Flows = flows
+		d.SetInsecureHosts(c.File.InsecureHosts)
+		d.Coalesce = c.File.Feature(FeatureCoalesce)
+		// The local server sends 100 Continue to the client when the body is
+		// read, which is after the remote server sent its 100 Continue.
+		d.Tr.ExpectContinueTimeout = expectContinueTimeout
+		d.KeepAlive = time.Millisecond * time.Duration(c.File.TCPKeepAliveMS)
+		d.EngineHeader = c.File.AddEngineHeader
+		d.EarlyHints = c.File.Feature(FeatureEarlyHints)
+		d.FlushInterval = time.Millisecond * time.Duration(c.File.FlushIntervalMS)
+		d.FlushBytes = c.File.FlushBytes
+		d.StreamKeepAlive = time.Millisecond * time.Duration(c.File.StreamKeepAliveMS)
+		d.MaxTunnelDuration = time.Millisecond * time.Duration(c.File.MaxTunnelDurationMS)
+		d.Via = c.File.Via()
+		d.StripVia = c.File.StripVia
+		d.ProxyAgent = c.File.ProxyAgent
+		if c.File.HonorRetryAfter {
+			d.MaxRetryAfter = time.Millisecond * time.Duration(c.File.MaxRetryAfterMS)
+			d.RetryMethods = c.File.RetryMethods
+		}
+	}
 	return
 }
 
@@ -109,38 +199,253 @@ func (self *Server) Blocked(host string) bool {
 //    Because we can be sure that all of them are http request, we can only redo the request
 //    to the remote server and copy the reponse to client.
 //
+// Requests go through the middlewares added by Use first.
 func (self *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	use := (self.Blocked(r.URL.Host) || self.Mode == NormalSrv) && r.URL.Host != ""
-	L.Printf("[%s] %s %s %s\n", AccessType(use), r.Method, r.RequestURI, r.Proto)
+	sw := &sentWriter{ResponseWriter: w}
+	defer self.recover(sw, r)
+	w = sw.wrap()
+	AbsoluteURL(r)
+	if self.handler != nil {
+		self.handler.ServeHTTP(w, r)
+	} else {
+		self.dispatch(w, r)
+	}
+}
+
+// Log the panic of a request with stack trace. The client gets a 500 if
+// nothing was sent yet, or the connection of it is aborted, so a truncated
+// response is not taken as complete. Other requests are still served.
+func (self *Server) recover(w *sentWriter, r *http.Request) {
+	err := recover()
+	if err == nil {
+		return
+	}
+	if err != http.ErrAbortHandler {
+		L.Printf("PANIC %s %s: %v\n%s", r.Method, r.RequestURI, err, debug.Stack())
+		if !w.sent.Load() {
+			// drop the headers set before the panic, e.g. Content-Length
+			for k := range w.Header() {
+				delete(w.Header(), k)
+			}
+			w.Header().Set("Connection", "close")
+			self.Pages.WriteError(w, r, &Error{Kind: ErrInternal, Op: r.Method + " " + r.RequestURI})
+			return
+		}
+	}
+	// the local server closes the connection quietly
+	panic(http.ErrAbortHandler)
+}
+
+// ResponseWriter noting whether the response was started or not
+type sentWriter struct {
+	http.ResponseWriter
+	// set by flushes of other goroutines too
+	sent atomic.Bool
+}
+
+// w with Hijack if the local one has it, HTTP/2 ones do not
+func (self *sentWriter) wrap() http.ResponseWriter {
+	if _, ok := self.ResponseWriter.(http.Hijacker); ok {
+		return sentHijacker{self}
+	}
+	return self
+}
+
+func (self *sentWriter) WriteHeader(code int) {
+	// 1xx are not the final response
+	if code >= 200 {
+		self.sent.Store(true)
+	}
+	self.ResponseWriter.WriteHeader(code)
+}
+
+func (self *sentWriter) Write(b []byte) (int, error) {
+	self.sent.Store(true)
+	return self.ResponseWriter.Write(b)
+}
+
+func (self *sentWriter) Flush() {
+	self.sent.Store(true)
+	if f, ok := self.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (self *sentWriter) Unwrap() http.ResponseWriter {
+	return self.ResponseWriter
+}
+
+type sentHijacker struct {
+	*sentWriter
+}
+
+func (self sentHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	self.sent.Store(true)
+	return self.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// Middleware wraps the handler of requests, e.g. for auth, logging or metrics.
+// It can reject a request by writing a response without calling next.
+type Middleware func(next http.Handler) http.Handler
+
+// Add middlewares around the proxy, the first added one runs first.
+// Should be called before serving.
+func (self *Server) Use(mws ...Middleware) {
+	self.middlewares = append(self.middlewares, mws...)
+	var h http.Handler = http.HandlerFunc(self.dispatch)
+	for i := len(self.middlewares) - 1; i >= 0; i-- {
+		h = self.middlewares[i](h)
+	}
+	self.handler = h
+}
+
+// Test whether r to host goes through the remote or not. Hosts in
+// remote_weights are routed by the hash of the client IP and host, so
+// a client sticks to the same fetcher of a host.
+func (self *Server) useRemote(f *ConfigFile, r *http.Request, host string) bool {
+	if host == "" {
+		return false
+	}
+	if self.Mode == NormalSrv {
+		return true
+	}
+	weight, ok := f.RemoteWeight(host)
+	if !ok {
+		return self.Blocked(host)
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	h := fnv.New32a()
+	h.Write([]byte(ip + " " + HostOnly(host)))
+	use := int(h.Sum32()%100) < weight
+	L.Printf("WEIGHTED %s for %s: %s (%d%% remote)\n", HostOnly(host), ip, AccessType(use), weight)
+	return use
+}
+
+// choose direct or remote fetcher for the request
+func (self *Server) dispatch(w http.ResponseWriter, r *http.Request) {
+	f := self.Cfg.Current()
+	start := time.Now()
+	// only proxied requests, /reload etc. still work in maintenance
+	if (r.Method == "CONNECT" || r.URL.IsAbs()) && self.inMaintenance(r) {
+		self.writeMaintenance(w, r, start)
+		return
+	}
+	// HTTP/1.0 clients may not send Host, the host of an absolute URL is enough
+	if r.URL.IsAbs() && r.URL.Host == "" {
+		L.Printf("%s %s has no host\n", r.Method, r.RequestURI)
+		http.Error(w, "missing host in request URL", http.StatusBadRequest)
+		self.Flows.Write(r, flowEngineLocal, http.StatusBadRequest, 0, 0, start)
+		return
+	}
+	if f.Looped(r.Header) {
+		err := &Error{Kind: ErrLoopDetected, Op: r.Method + " " + r.RequestURI}
+		L.Println(err)
+		self.reject(w, r, err, start)
+		return
+	}
+	if !f.MethodAllowed(r.Method) {
+		err := &Error{Kind: ErrMethodNotAllowed, Op: r.Method + " " + r.RequestURI}
+		L.Println(err)
+		w.Header().Set("Allow", f.Allow())
+		self.reject(w, r, err, start)
+		return
+	}
+
+	use := self.useRemote(f, r, r.URL.Host)
+	if f.LogClientChain {
+		L.Printf("[%s] %s %s %s %s\n", AccessType(use), r.Method, r.RequestURI, r.Proto, ClientChain(r, f.TrustedNets()))
+	} else {
+		L.Printf("[%s] %s %s %s\n", AccessType(use), r.Method, r.RequestURI, r.Proto)
+	}
+
+	if r.Method == "CONNECT" || r.URL.IsAbs() {
+		bulk := f.Bulk(r)
+		if !self.Limit.acquire(r, bulk) {
+			err := &Error{Kind: ErrOverloaded, Op: r.Method + " " + r.RequestURI}
+			L.Printf("%s, %d queued\n", err, self.Limit.QueueDepth())
+			self.reject(w, r, err, start)
+			return
+		}
+		defer self.Limit.release(bulk)
+	}
 
 	if r.Method == "CONNECT" {
 		if use {
-			self.SSH.Connect(w, r)
+			self.Remote.Connect(w, r)
 		} else {
 			err := self.Direct.Connect(w, r)
 			if err == ErrShouldProxy {
-				self.SSH.Connect(w, r)
+				self.Remote.Connect(w, r)
 			}
 		}
 	} else if r.URL.IsAbs() {
+		ctx := r.Context()
+		if d := f.Timeout(r.URL.Host); d > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+		// Leave the client request as is, the local server still reads its headers,
+		// e.g. Connection: keep-alive from HTTP/1.0 clients.
+		r = r.Clone(ctx)
 		// This is an error if is not empty on Client
 		r.RequestURI = ""
-		RemoveHopHeaders(r.Header)
+		StripFragment(r.URL)
+		RemoveHopHeadersExcept(r.Header, self.Cfg.PreserveHeaders())
+		SetVia(r.Header, r.ProtoMajor, r.ProtoMinor, f.Via(), f.StripVia)
+		if max := f.MaxRequestBody; max > 0 && r.Body != nil && r.Body != http.NoBody {
+			if r.ContentLength > max {
+				err := &Error{Kind: ErrTooLarge, Op: r.Method + " " + r.URL.String()}
+				L.Println(err)
+				self.reject(w, r, err, start)
+				return
+			}
+			// chunked body without Content-Length
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+		}
 		if use {
-			self.SSH.ServeHTTP(w, r)
+			self.Remote.ServeHTTP(w, r)
 		} else {
+			// the transport closes the body when the dial fails, keep it for the remote
+			body := r.Body
+			if body != nil && body != http.NoBody {
+				r.Body = ioutil.NopCloser(body)
+			}
 			err := self.Direct.ServeHTTP(w, r)
 			if err == ErrShouldProxy {
-				self.SSH.ServeHTTP(w, r)
+				// timed out to connect, nothing was sent yet
+				r.Body = body
+				self.Remote.ServeHTTP(w, r)
 			}
 		}
+	} else if r.Method == "OPTIONS" && r.RequestURI == "*" {
+		// asks the capabilities of the proxy itself
+		w.Header().Set("Allow", f.Allow())
+		w.Header().Set("Content-Length", "0")
 	} else if r.URL.Path == "/reload" {
 		self.reload(w, r)
+	} else if r.URL.Path == "/maintenance" {
+		self.maintenanceEndpoint(w, r)
+	} else if r.URL.Path == "/status" {
+		fmt.Fprintf(w, "connections %d\nqueued %d\n", self.Conns.Open(), self.Limit.QueueDepth())
+	} else if r.URL.Path == "/version" {
+		w.Write([]byte(BuildInfo() + "\n"))
 	} else {
 		L.Printf("%s is not a full URL path\n", r.RequestURI)
+		self.landing(w, r)
 	}
 }
 
+// Write the page of err to the client of r, which is not sent to a fetcher,
+// and the flow record of it
+func (self *Server) reject(w http.ResponseWriter, r *http.Request, err error, start time.Time) {
+	self.Pages.WriteError(w, r, err)
+	self.Flows.Write(r, flowEngineLocal, statusOf(err), 0, 0, start)
+}
+
 func (self *Server) reload(w http.ResponseWriter, r *http.Request) {
 	err := self.Cfg.Reload()
 	if err != nil {
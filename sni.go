@@ -0,0 +1,44 @@
+package mallory
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var errSNIRead = errors.New("server name read")
+
+// conn reading from r, writes are dropped
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (self *readOnlyConn) Read(p []byte) (int, error) {
+	return self.r.Read(p)
+}
+
+func (self *readOnlyConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// Peek the server name in the TLS ClientHello from conn, waiting at most timeout.
+// The name is empty if conn is not TLS or has no SNI. The returned conn reads
+// the ClientHello again, which is tunneled as is without terminating TLS.
+func PeekSNI(conn net.Conn, timeout time.Duration) (string, net.Conn) {
+	var buf bytes.Buffer
+	var name string
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	tls.Server(&readOnlyConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errSNIRead
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	return name, &bufferedConn{Conn: conn, r: bufio.NewReader(io.MultiReader(&buf, conn))}
+}
@@ -24,6 +24,8 @@ type SSH struct {
 	Client *ssh.Client
 	// SSH client config
 	CliCfg *ssh.ClientConfig
+	// dialer of the connection to remote server
+	Dialer *net.Dialer
 	// direct fetcher
 	Direct *Direct
 	// only re-dial once
@@ -43,6 +45,11 @@ func NewSSH(c *Config) (self *SSH, err error) {
 		return
 	}
 
+	self.Dialer, err = NewDialer(c.File.DialSourceIP)
+	if err != nil {
+		return
+	}
+
 	if self.URL.User != nil {
 		self.CliCfg.User = self.URL.User.Username()
 	} else {
@@ -98,7 +105,7 @@ func NewSSH(c *Config) (self *SSH, err error) {
 	}
 
 	// first time to dial to remote server, make sure it is available
-	self.Client, err = ssh.Dial("tcp", self.URL.Host, self.CliCfg)
+	self.Client, err = self.dial()
 	if err != nil {
 		return
 	}
@@ -116,7 +123,7 @@ func NewSSH(c *Config) (self *SSH, err error) {
 		L.Printf("dial %s failed: %s, reconnecting ssh server %s...\n", addr, err, self.URL.Host)
 
 		clif, err := self.sf.Do(network+addr, func() (interface{}, error) {
-			return ssh.Dial("tcp", self.URL.Host, self.CliCfg)
+			return self.dial()
 		})
 		if err != nil {
 			L.Printf("connect ssh server %s failed: %s\n", self.URL.Host, err)
@@ -132,11 +139,26 @@ func NewSSH(c *Config) (self *SSH, err error) {
 	}
 
 	self.Direct = &Direct{
-		Tr: &http.Transport{Dial: dial},
+		Name: "ssh",
+		Tr:   &http.Transport{Dial: dial},
 	}
 	return
 }
 
+// connect the remote SSH server
+func (self *SSH) dial() (*ssh.Client, error) {
+	conn, err := self.Dialer.Dial("tcp", self.URL.Host)
+	if err != nil {
+		return nil, &Error{Kind: ErrBackendUnreachable, Op: "ssh.Dial", Err: err}
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, self.URL.Host, self.CliCfg)
+	if err != nil {
+		conn.Close()
+		return nil, &Error{Kind: ErrHandshake, Op: "ssh.Dial", Err: err}
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
 func (self *SSH) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	self.Direct.ServeHTTP(w, r)
 }
@@ -0,0 +1,132 @@
+package mallory
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// Serve connections redirected to l by iptables, each one is tunneled to its
+// original destination through the direct or remote fetcher, like CONNECT.
+// l is from ListenTransparent.
+func (self *Server) ServeTransparent(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				L.Printf("Accept: %s\n", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go self.serveTransparent(l, conn)
+	}
+}
+
+// longest wait for the TLS ClientHello of transparent connections
+const transparentSNITimeout = 5 * time.Second
+
+// test whether connections to port are peeked for SNI or not
+func (self *Server) sniPort(port string) bool {
+	for _, p := range self.Cfg.Current().TransparentSNIPorts {
+		if strconv.Itoa(p) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// test whether host is the address of l or not, l may listen on a wildcard
+// address like [::]:1317, which is any address of this host
+func isListener(l net.Listener, host string) bool {
+	la, ok := l.Addr().(*net.TCPAddr)
+	if !ok || !la.IP.IsUnspecified() {
+		return host == l.Addr().String()
+	}
+	return isSelf(la, host)
+}
+
+// Log the panic of a transparent connection with stack trace, only the
+// connection is closed, others are still served.
+func (self *Server) recoverTransparent(conn net.Conn) {
+	err := recover()
+	if err != nil && err != http.ErrAbortHandler {
+		L.Printf("PANIC TRANSPARENT %s: %v\n%s", conn.RemoteAddr(), err, debug.Stack())
+	}
+}
+
+func (self *Server) serveTransparent(l net.Listener, conn net.Conn) {
+	defer conn.Close()
+	defer self.recoverTransparent(conn)
+	start := time.Now()
+
+	host, err := OriginalDst(conn)
+	if err != nil {
+		L.Printf("Transparent %s: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	// not redirected, e.g. connected to the listener directly
+	if isListener(l, host) {
+		L.Printf("Transparent %s: not redirected, closed\n", conn.RemoteAddr())
+		return
+	}
+
+	// route TLS by the server name, the destination IP may be shared by many
+	// hosts, and those in blocked list are only matched by name.
+	ip, port, _ := net.SplitHostPort(host)
+	if self.sniPort(port) {
+		var name string
+		name, conn = PeekSNI(conn, transparentSNITimeout)
+		if name != "" {
+			host = net.JoinHostPort(name, port)
+			L.Printf("Transparent %s: SNI %s\n", ip, name)
+		}
+	}
+
+	// the tunnel as a CONNECT request, for routing and logs
+	r := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: host},
+		Host:       host,
+		RequestURI: host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	if self.inMaintenance(r) {
+		L.Println(&Error{Kind: ErrMaintenance, Op: "Transparent " + host})
+		return
+	}
+
+	use := self.useRemote(self.Cfg.Current(), r, host)
+	L.Printf("[%s] TRANSPARENT %s\n", AccessType(use), host)
+
+	bulk := self.Cfg.Current().Bulk(r)
+	if !self.Limit.acquire(r, bulk) {
+		L.Printf("%s, %d queued\n", &Error{Kind: ErrOverloaded, Op: "Transparent " + host}, self.Limit.QueueDepth())
+		return
+	}
+	defer self.Limit.release(bulk)
+
+	d := self.Direct
+	if use {
+		d = self.Remote
+	}
+	dst, err := d.dialTunnel(host)
+	if err == ErrShouldProxy {
+		d = self.Remote
+		dst, err = d.dialTunnel(host)
+	}
+	if err != nil {
+		return
+	}
+	defer dst.Close()
+
+	d.tunnel(r, conn, dst, start)
+}
@@ -0,0 +1,133 @@
+package mallory
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// from linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const (
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+)
+
+// Listen on addr for connections redirected by iptables, with the REDIRECT
+// target or, if tproxy is set, the TPROXY target which needs CAP_NET_ADMIN.
+func ListenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &transparentListener{Listener: l, tproxy: tproxy}, nil
+}
+
+type transparentListener struct {
+	net.Listener
+	tproxy bool
+}
+
+func (self *transparentListener) Accept() (net.Conn, error) {
+	conn, err := self.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &transparentConn{Conn: conn, tproxy: self.tproxy}, nil
+}
+
+// connection accepted by ListenTransparent
+type transparentConn struct {
+	net.Conn
+	tproxy bool
+}
+
+func (self *transparentConn) NetConn() net.Conn {
+	return self.Conn
+}
+
+func (self *transparentConn) CloseWrite() error {
+	if c, ok := self.Conn.(closeWriter); ok {
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+// Original destination host:port of a connection accepted by ListenTransparent,
+// its local address with TPROXY, or SO_ORIGINAL_DST with REDIRECT.
+func OriginalDst(conn net.Conn) (string, error) {
+	tc, ok := conn.(*transparentConn)
+	for !ok {
+		u, wrapped := conn.(netConner)
+		if !wrapped {
+			return "", errors.New("not a transparent connection")
+		}
+		conn = u.NetConn()
+		tc, ok = conn.(*transparentConn)
+	}
+	if tc.tproxy {
+		return tc.LocalAddr().String(), nil
+	}
+	tcpConn, ok := tc.Conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var addr string
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		addr, serr = originalDst(int(fd), tcpConn.LocalAddr().(*net.TCPAddr).IP.To4() == nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	return addr, serr
+}
+
+// getsockopt SO_ORIGINAL_DST of fd, the sockaddr_in fits in IPv6Mreq and
+// the sockaddr_in6 in IPv6MTUInfo, which work on all architectures.
+func originalDst(fd int, ipv6 bool) (string, error) {
+	if ipv6 {
+		info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.SOL_IPV6, ip6tSoOriginalDst)
+		if err != nil {
+			return "", &net.OpError{Op: "getsockopt", Net: "tcp", Err: err}
+		}
+		port := ntohs(info.Addr.Port)
+		return net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(port))), nil
+	}
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.SOL_IP, soOriginalDst)
+	if err != nil {
+		return "", &net.OpError{Op: "getsockopt", Net: "tcp", Err: err}
+	}
+	// sockaddr_in: family, port, addr
+	b := mreq.Multiaddr
+	port := binary.BigEndian.Uint16(b[2:4])
+	return net.JoinHostPort(net.IP(b[4:8]).String(), strconv.Itoa(int(port))), nil
+}
+
+// port of RawSockaddrInet6 is in network byte order
+func ntohs(port uint16) uint16 {
+	var b [2]byte
+	*(*uint16)(unsafe.Pointer(&b[0])) = port
+	return binary.BigEndian.Uint16(b[:])
+}
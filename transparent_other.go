@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package mallory
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparent = errors.New("transparent proxy is only supported on Linux")
+
+// Listen on addr for connections redirected by iptables, Linux only.
+func ListenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	return nil, errTransparent
+}
+
+// Original destination host:port of a connection accepted by ListenTransparent, Linux only.
+func OriginalDst(conn net.Conn) (string, error) {
+	return "", errTransparent
+}
@@ -0,0 +1,36 @@
+package mallory
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build info, set at build time by -ldflags "-X github.com/justmao945/mallory.Version=v1.0.0 ...",
+// see README
+var (
+	Version   = ""
+	Commit    = ""
+	BuildDate = ""
+)
+
+// BuildInfo returns e.g. "mallory v1.0.0 (commit 1a2b3c4, built 2022-06-01T00:00:00Z, go1.18)"
+func BuildInfo() string {
+	version := Version
+	if version == "" {
+		// installed by go install ...@version
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+			version = info.Main.Version
+		} else {
+			version = "(devel)"
+		}
+	}
+	commit, date := Commit, BuildDate
+	if commit == "" {
+		commit = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return fmt.Sprintf("mallory %s (commit %s, built %s, %s)", version, commit, date, runtime.Version())
+}